@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+
+	pr "github.com/number571/hes/protocol"
+)
+
+// Client sends and receives emails without the database,
+// emails of the web client and of the nodes are the same.
+type Client struct {
+	priv  cr.PrivKey
+	conns [][2]string
+	hc    *http.Client
+	seen  map[string]bool
+	mtx   sync.Mutex
+}
+
+// Connection = [host, password].
+func NewClient(priv cr.PrivKey, conns [][2]string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{
+		priv:  priv,
+		conns: conns,
+		hc:    hc,
+		seen:  make(map[string]bool),
+	}
+}
+
+// Sender is set by the receiver from the package,
+// SenderName is only the name proposed by the sender.
+type Email struct {
+	Hash       string
+	SenderName string
+	Sender     cr.PubKey
+	Head       string
+	Body       string
+	Files      []File
+}
+
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Error of one node.
+type ServerError struct {
+	Addr string
+	Err  error
+}
+
+func (err *ServerError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Addr, err.Err.Error())
+}
+
+func (err *ServerError) Unwrap() error {
+	return err.Err
+}
+
+// Errors of the nodes in the order of the connections.
+type Errors []*ServerError
+
+func (errs Errors) Error() string {
+	list := make([]string, len(errs))
+	for i, err := range errs {
+		list[i] = err.Error()
+	}
+	return strings.Join(list, "; ")
+}
+
+func (client *Client) PubKey() cr.PubKey {
+	return client.priv.PubKey()
+}
+
+// The email is delivered if at least one node accepted it,
+// Errors contains the nodes which did not.
+func (client *Client) Send(ctx context.Context, recv cr.PubKey, email Email) error {
+	if recv == nil {
+		return fmt.Errorf("receiver is null")
+	}
+	name := strings.TrimSpace(email.SenderName)
+	if len(name) < 6 || len(name) > 64 {
+		return fmt.Errorf("len username < 6 or > 64")
+	}
+	head := strings.TrimSpace(email.Head)
+	body := strings.TrimSpace(email.Body)
+	if head == "" || body == "" {
+		return fmt.Errorf("head or body is null")
+	}
+	for _, file := range email.Files {
+		head += pr.FSEPARAT + file.Name
+		body += pr.FSEPARAT + en.Base64Encode(file.Data)
+	}
+	pack, err := pr.NewPackage(client.priv, recv, pr.NewEmail(name, head, body))
+	if err != nil {
+		return err
+	}
+	if len(client.conns) == 0 {
+		return fmt.Errorf("connections is null")
+	}
+	var (
+		results = make([]error, len(client.conns))
+		errs    Errors
+		wg      sync.WaitGroup
+	)
+	for i, conn := range client.conns {
+		wg.Add(1)
+		go func(i int, conn [2]string) {
+			defer wg.Done()
+			results[i] = pr.Send(ctx, client.hc, conn, recv, pack)
+		}(i, conn)
+	}
+	wg.Wait()
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, &ServerError{Addr: client.conns[i][0], Err: err})
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Only emails which were not returned before are returned,
+// Errors contains the nodes which failed. Nodes have no cursor,
+// so all packages of the receiver are downloaded every time
+// and skipped by the hashes of the seen emails.
+func (client *Client) Fetch(ctx context.Context) ([]Email, error) {
+	var (
+		emails []Email
+		errs   Errors
+	)
+	for _, conn := range client.conns {
+		err := pr.Load(ctx, client.hc, conn[0], client.priv, 0, func(pack lc.Message) error {
+			email, err := client.readEmail(pack)
+			if err != nil {
+				return err
+			}
+			emails = append(emails, *email)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, &ServerError{Addr: conn[0], Err: err})
+		}
+	}
+	if errs != nil {
+		return emails, errs
+	}
+	return emails, nil
+}
+
+// Hashes of the returned emails, the set grows with every new email.
+// Nodes delete packages after some time, so the caller can save
+// the hashes and pass back only the recent ones by SetSeen.
+func (client *Client) Seen() []string {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	hashes := make([]string, 0, len(client.seen))
+	for hash := range client.seen {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// The seen set is replaced, emails with other hashes
+// are returned by the next Fetch.
+func (client *Client) SetSeen(hashes []string) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.seen = make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		client.seen[hash] = true
+	}
+}
+
+func (client *Client) readEmail(pack lc.Message) (*Email, error) {
+	title, data := pack.Export()
+	if string(title) != pr.IS_EMAIL {
+		return nil, fmt.Errorf("is not email")
+	}
+	hash := en.Base64Encode(pack.Body.Hash)
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	if client.seen[hash] {
+		return nil, fmt.Errorf("email already exist")
+	}
+	sender := pr.LoadPubKey(pack.Head.Sender)
+	if sender == nil {
+		return nil, fmt.Errorf("public key is null")
+	}
+	var email pr.Email
+	err := json.Unmarshal(data, &email)
+	if err != nil {
+		return nil, fmt.Errorf("json decode")
+	}
+	name := strings.TrimSpace(email.SenderName)
+	if len(name) < 6 || len(name) > 64 {
+		return nil, fmt.Errorf("len username < 6 or > 64")
+	}
+	heads := strings.Split(email.Head, pr.FSEPARAT)
+	bodys := strings.Split(email.Body, pr.FSEPARAT)
+	if len(heads) != len(bodys) {
+		return nil, fmt.Errorf("len.head != len.body")
+	}
+	head := strings.TrimSpace(heads[0])
+	body := strings.TrimSpace(bodys[0])
+	if head == "" || body == "" {
+		return nil, fmt.Errorf("head or body is null")
+	}
+	var files []File
+	for i := 1; i < len(heads); i++ {
+		files = append(files, File{
+			Name: heads[i],
+			Data: en.Base64Decode(bodys[i]),
+		})
+	}
+	client.seen[hash] = true
+	return &Email{
+		Hash:       hash,
+		SenderName: name,
+		Sender:     sender,
+		Head:       head,
+		Body:       body,
+		Files:      files,
+	}, nil
+}
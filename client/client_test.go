@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+	rl "github.com/number571/hes/relay"
+)
+
+func TestMain(m *testing.M) {
+	hestest.Main(m)
+}
+
+func newTestNode(t *testing.T) *httptest.Server {
+	db := rl.NewDB(filepath.Join(t.TempDir(), "hes.db"))
+	relay := rl.NewRelay(db, &rl.CFG{Pasw: "pasw"}, http.DefaultClient)
+	srv := httptest.NewServer(relay.Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSend(t *testing.T) {
+	node := newTestNode(t)
+	recv := pr.NewPrivKey("x25519").PubKey()
+	tests := []struct {
+		name  string
+		conns [][2]string
+		email Email
+		ok    bool
+		nodes int
+	}{
+		{"valid", [][2]string{{node.URL, "pasw"}}, Email{SenderName: "sender", Head: "head", Body: "body"}, true, 0},
+		{"head", [][2]string{{node.URL, "pasw"}}, Email{SenderName: "sender", Body: "body"}, false, 0},
+		{"body", [][2]string{{node.URL, "pasw"}}, Email{SenderName: "sender", Head: "head", Body: " "}, false, 0},
+		{"short name", [][2]string{{node.URL, "pasw"}}, Email{SenderName: " name ", Head: "head", Body: "body"}, false, 0},
+		{"long name", [][2]string{{node.URL, "pasw"}}, Email{SenderName: strings.Repeat("n", 65), Head: "head", Body: "body"}, false, 0},
+		{"connections", nil, Email{SenderName: "sender", Head: "head", Body: "body"}, false, 0},
+		{"password", [][2]string{{node.URL, "pasw"}, {node.URL, "other"}}, Email{SenderName: "sender", Head: "head", Body: "body"}, false, 1},
+	}
+	for _, tt := range tests {
+		client := NewClient(pr.NewPrivKey("x25519"), tt.conns, node.Client())
+		err := client.Send(context.Background(), recv, tt.email)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+		var errs Errors
+		if errors.As(err, &errs) != (tt.nodes != 0) || len(errs) != tt.nodes {
+			t.Errorf("%s: errors of nodes %v", tt.name, err)
+		}
+	}
+	client := NewClient(pr.NewPrivKey("x25519"), [][2]string{{node.URL, "pasw"}}, nil)
+	if client.Send(context.Background(), nil, Email{SenderName: "sender", Head: "head", Body: "body"}) == nil {
+		t.Error("email without receiver is sent")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	var (
+		node1 = newTestNode(t)
+		node2 = newTestNode(t)
+		down  = newTestNode(t)
+	)
+	down.Close()
+	conns := [][2]string{{node1.URL, "pasw"}, {node2.URL, "pasw"}}
+	sender := NewClient(pr.NewPrivKey("rsa-2048"), conns, nil)
+	recv := NewClient(pr.NewPrivKey("x25519"), append(conns, [2]string{down.URL, "pasw"}), nil)
+	email := Email{
+		SenderName: "sender",
+		Head:       "head",
+		Body:       "body",
+		Files:      []File{{Name: "file.txt", Data: []byte("data")}},
+	}
+	if err := sender.Send(context.Background(), recv.PubKey(), email); err != nil {
+		t.Fatal(err)
+	}
+	emails, err := recv.Fetch(context.Background())
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Addr != down.URL {
+		t.Errorf("errors of nodes %v", err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("loaded %d emails from two nodes", len(emails))
+	}
+	got := emails[0]
+	if got.SenderName != "sender" || got.Head != "head" || got.Body != "body" {
+		t.Errorf("email is changed: %+v", got)
+	}
+	if got.Sender.String() != sender.PubKey().String() {
+		t.Errorf("sender is changed")
+	}
+	if len(got.Files) != 1 || got.Files[0].Name != "file.txt" || !bytes.Equal(got.Files[0].Data, []byte("data")) {
+		t.Errorf("files are changed: %v", got.Files)
+	}
+	emails, _ = recv.Fetch(context.Background())
+	if len(emails) != 0 {
+		t.Errorf("email is loaded again")
+	}
+	if seen := recv.Seen(); len(seen) != 1 || seen[0] != got.Hash {
+		t.Errorf("seen hashes %v", seen)
+	}
+	recv.SetSeen(nil)
+	if emails, _ = recv.Fetch(context.Background()); len(emails) != 1 {
+		t.Errorf("email is not loaded after reset of seen hashes")
+	}
+	other := NewClient(pr.NewPrivKey("x25519"), conns, nil)
+	if emails, err := other.Fetch(context.Background()); err != nil || len(emails) != 0 {
+		t.Errorf("other receiver: %d emails, error %v", len(emails), err)
+	}
+}
+
+// Packages of other clients are checked as in the web client.
+func TestFetchInvalid(t *testing.T) {
+	node := newTestNode(t)
+	conns := [][2]string{{node.URL, "pasw"}}
+	recv := NewClient(pr.NewPrivKey("x25519"), conns, nil)
+	tests := []struct {
+		sender string
+		head   string
+		body   string
+	}{
+		{"name", "head", "body"},
+		{"sender", " ", "body"},
+		{"sender", "head", "\n"},
+		{"sender", pr.FSEPARAT + "file.txt", pr.FSEPARAT + "ZGF0YQ=="},
+		{"sender", "  head  ", " body "}, // the only valid
+	}
+	for _, tt := range tests {
+		pack, err := pr.NewPackage(pr.NewPrivKey("x25519"), recv.PubKey(), pr.NewEmail(tt.sender, tt.head, tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.Send(context.Background(), node.Client(), conns[0], recv.PubKey(), pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emails, err := recv.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].Head != "head" || emails[0].Body != "body" {
+		t.Errorf("loaded emails %+v", emails)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	en "github.com/number571/go-peer/encoding"
+	gp "github.com/number571/go-peer/settings"
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
+)
+
+// The API uses the sessions of the web interface,
+// token is passed in the header 'Authorization: Bearer token'.
+const (
+	API_PREFIX = "/api/v1"
+)
+
+type APIResponse struct {
+	Return int         `json:"return"`
+	Result interface{} `json:"result"`
+}
+
+type APIEmail struct {
+	Hash       string      `json:"hash"`
+	SenderName string      `json:"sender_name"`
+	SenderPubl string      `json:"sender_publ"`
+	Contact    string      `json:"contact,omitempty"`
+	Identity   string      `json:"identity,omitempty"`
+	Head       string      `json:"head"`
+	Body       string      `json:"body,omitempty"`
+	Time       string      `json:"time"`
+	Files      [][2]string `json:"files,omitempty"`
+}
+
+type APIConnect struct {
+	Host     string `json:"host"`
+	Password string `json:"password,omitempty"`
+}
+
+func handleAPI() {
+	http.HandleFunc(API_PREFIX+"/signin", apiSigninPage)
+	http.HandleFunc(API_PREFIX+"/signout", apiSignoutPage)
+	http.HandleFunc(API_PREFIX+"/emails", apiEmailsPage)
+	http.HandleFunc(API_PREFIX+"/emails/", apiEmailPage)
+	http.HandleFunc(API_PREFIX+"/contacts", apiContactsPage)
+	http.HandleFunc(API_PREFIX+"/connects", apiConnectsPage)
+}
+
+// POST {username, password, code} -> token
+func apiSigninPage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if r.Method != "POST" {
+		apiError(w, http.StatusMethodNotAllowed, "error: method is not allowed")
+		return
+	}
+	if !apiDecode(w, r, &req) {
+		return
+	}
+	user := DATABASE.GetUser(req.Username, req.Password)
+	if user == nil {
+		apiError(w, http.StatusUnauthorized, "error: username of password incorrect")
+		return
+	}
+	if !DATABASE.CheckTOTP(user, req.Code) {
+		DATABASE.WipeUser(user)
+		apiError(w, http.StatusUnauthorized, "error: two-factor code incorrect")
+		return
+	}
+	user = SESSIONS.Share(user)
+	defer SESSIONS.Release(user)
+	err := DATABASE.UpgradeKDF(user, req.Password)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, fmt.Sprintf("error: %s", err.Error()))
+		return
+	}
+	apiResult(w, map[string]string{
+		"token": SESSIONS.NewToken(r, user),
+	})
+}
+
+func apiSignoutPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, http.StatusMethodNotAllowed, "error: method is not allowed")
+		return
+	}
+	if apiUser(w, r) == nil {
+		return
+	}
+	SESSIONS.DelByToken(readBearer(r))
+	apiResult(w, "success: session closed")
+}
+
+// GET ?page=N      -> list of emails without bodies
+// POST {fetch}     -> load new emails, result by nodes
+// POST {receiver, sender, head, body, files} -> send email
+func apiEmailsPage(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(w, r)
+	if user == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			page = 0
+		}
+		list := []APIEmail{}
+		for _, email := range DATABASE.GetEmails(user, page*MAXEPAGE, MAXEPAGE) {
+			list = append(list, newAPIEmail(&email, false))
+		}
+		apiResult(w, list)
+	case "POST":
+		var req struct {
+			Fetch    bool        `json:"fetch"`
+			Receiver string      `json:"receiver"`
+			Sender   string      `json:"sender"`
+			Head     string      `json:"head"`
+			Body     string      `json:"body"`
+			Files    [][2]string `json:"files"`
+		}
+		if !apiDecode(w, r, &req) {
+			return
+		}
+		if req.Fetch {
+			apiResult(w, fetchEmails(user))
+			return
+		}
+		recv := pr.LoadPubKeyByString(req.Receiver)
+		if recv == nil {
+			apiError(w, http.StatusBadRequest, "error: receiver is null")
+			return
+		}
+		if req.Sender == "" {
+			req.Sender = user.Priv().PubKey().String()
+		}
+		sender := getIdentity(user, req.Sender)
+		if sender == nil {
+			apiError(w, http.StatusBadRequest, "error: sender is null")
+			return
+		}
+		head := strings.TrimSpace(req.Head)
+		body := strings.TrimSpace(req.Body)
+		if head == "" || body == "" {
+			apiError(w, http.StatusBadRequest, "error: head or body is null")
+			return
+		}
+		for _, file := range req.Files {
+			if en.Base64Decode(file[1]) == nil {
+				apiError(w, http.StatusBadRequest, "error: file is not base64")
+				return
+			}
+			head += pr.FSEPARAT + file[0]
+			body += pr.FSEPARAT + file[1]
+		}
+		err := sendMessage(user, sender.Priv, recv, pr.NewEmail(sender.Name, head, body))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+		if !DATABASE.IsVerified(user, recv) {
+			apiWrite(w, http.StatusOK, APIResponse{
+				Return: RET_WARNING,
+				Result: "success: email send (warning: receiver's key is not verified)",
+			})
+			return
+		}
+		apiResult(w, "success: email send")
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "error: method is not allowed")
+	}
+}
+
+// GET    /emails/{hash} -> email with body and files
+// DELETE /emails/{hash}
+func apiEmailPage(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(w, r)
+	if user == nil {
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, API_PREFIX+"/emails/")
+	email := DATABASE.GetEmailByHash(user, hash)
+	if email == nil {
+		apiError(w, http.StatusNotFound, "error: email undefined")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		apiResult(w, newAPIEmail(email, true))
+	case "DELETE":
+		err := DATABASE.DelEmail(user, hash)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+		apiResult(w, "success: email deleted")
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "error: method is not allowed")
+	}
+}
+
+// GET -> contacts, POST {name, publ}, DELETE {publ}
+func apiContactsPage(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(w, r)
+	if user == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		contacts := DATABASE.GetContacts(user)
+		if contacts == nil {
+			contacts = []sr.Contact{}
+		}
+		apiResult(w, contacts)
+	case "POST":
+		var req sr.Contact
+		if !apiDecode(w, r, &req) {
+			return
+		}
+		err := DATABASE.SetContact(user, req.Name, pr.LoadPubKeyByString(req.Publ))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+		apiResult(w, "success: contact append")
+	case "DELETE":
+		var req sr.Contact
+		if !apiDecode(w, r, &req) {
+			return
+		}
+		err := DATABASE.DelContact(user, pr.LoadPubKeyByString(req.Publ))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+		apiResult(w, "success: contact deleted")
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "error: method is not allowed")
+	}
+}
+
+// GET -> connections, POST {host, password}, DELETE {host}
+func apiConnectsPage(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(w, r)
+	if user == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		conns := []APIConnect{}
+		for _, conn := range DATABASE.GetConns(user) {
+			conns = append(conns, APIConnect{Host: conn[0]})
+		}
+		apiResult(w, conns)
+	case "POST":
+		var req APIConnect
+		if !apiDecode(w, r, &req) {
+			return
+		}
+		err := DATABASE.SetConn(user, req.Host, req.Password)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+		apiResult(w, "success: connect append")
+	case "DELETE":
+		var req APIConnect
+		if !apiDecode(w, r, &req) {
+			return
+		}
+		err := DATABASE.DelConn(user, req.Host)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+		apiResult(w, "success: connect deleted")
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "error: method is not allowed")
+	}
+}
+
+func newAPIEmail(email *sr.Email, full bool) APIEmail {
+	texts := getTexts(email)
+	result := APIEmail{
+		Hash:       email.Hash,
+		SenderName: email.SenderName,
+		SenderPubl: email.SenderPubl,
+		Contact:    email.Contact,
+		Identity:   email.Identity,
+		Head:       texts[0],
+		Time:       email.Time,
+	}
+	if full {
+		result.Body = texts[1]
+		result.Files = getFiles(email)
+	}
+	return result
+}
+
+func apiUser(w http.ResponseWriter, r *http.Request) *sr.User {
+	user := SESSIONS.GetByToken(readBearer(r))
+	if user == nil {
+		apiError(w, http.StatusUnauthorized, "error: token is not valid")
+	}
+	return user
+}
+
+func readBearer(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func apiDecode(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(st.SETTINGS.Get(gp.SizePack)))
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "error: parse json")
+		return false
+	}
+	return true
+}
+
+func apiResult(w http.ResponseWriter, result interface{}) {
+	apiWrite(w, http.StatusOK, APIResponse{
+		Return: RET_SUCCESS,
+		Result: result,
+	})
+}
+
+func apiError(w http.ResponseWriter, status int, result string) {
+	apiWrite(w, status, APIResponse{
+		Return: RET_DANGER,
+		Result: result,
+	})
+}
+
+func apiWrite(w http.ResponseWriter, status int, resp APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(st.Serialize(resp))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	gp "github.com/number571/go-peer/settings"
+
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
+)
+
+type Archive struct {
+	KDF  string `json:"kdf"`
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+	Data string `json:"data"`
+}
+
+type AddressBook struct {
+	Contacts []sr.Contact `json:"contacts"`
+	Connects [][2]string  `json:"connects"`
+}
+
+// Old key is saved only during the grace period of the rotation,
+// deleted emails are saved only by package hashes.
+type Backup struct {
+	PrivKey    string       `json:"priv_key"`
+	OldPrivKey string       `json:"old_priv_key,omitempty"`
+	Rotated    int64        `json:"rotated,omitempty"`
+	Identities [][2]string  `json:"identities"`
+	F2F        bool         `json:"f2f"`
+	Contacts   []sr.Contact `json:"contacts"`
+	Connects   [][2]string  `json:"connects"`
+	Emails     []sr.Email   `json:"emails"`
+	Deleted    []string     `json:"deleted"`
+}
+
+// key  = kdf(password, salt)
+// data = encrypt[key](json(content))
+// hash = hmac[key](data)
+// Archives without kdf are hardened by sr.KDFLEGACY.
+func packArchive(pasw string, content interface{}) ([]byte, error) {
+	if len(pasw) < 8 {
+		return nil, fmt.Errorf("need len password >= 8")
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("json encode")
+	}
+	kdf := DATABASE.KDF()
+	salt := cr.RandBytes(st.SETTINGS.Get(gp.SizeSkey))
+	bpasw, err := sr.DeriveKey(kdf, []byte(pasw), salt)
+	if err != nil {
+		return nil, err
+	}
+	encd := cr.NewCipher(bpasw).Encrypt(data)
+	return st.Serialize(Archive{
+		KDF:  kdf,
+		Salt: en.Base64Encode(salt),
+		Hash: en.Base64Encode(cr.NewHasherMAC(encd, bpasw).Bytes()),
+		Data: en.Base64Encode(encd),
+	}), nil
+}
+
+func unpackArchive(pasw string, archive []byte, content interface{}) error {
+	var arch Archive
+	err := json.Unmarshal(archive, &arch)
+	if err != nil {
+		return fmt.Errorf("archive is not valid")
+	}
+	salt := en.Base64Decode(arch.Salt)
+	encd := en.Base64Decode(arch.Data)
+	if salt == nil || encd == nil {
+		return fmt.Errorf("archive is not valid")
+	}
+	if arch.KDF == "" {
+		arch.KDF = sr.KDFLEGACY
+	}
+	bpasw, err := sr.DeriveKey(arch.KDF, []byte(pasw), salt)
+	if err != nil {
+		return err
+	}
+	hash := cr.NewHasherMAC(encd, bpasw).Bytes()
+	if !bytes.Equal(hash, en.Base64Decode(arch.Hash)) {
+		return fmt.Errorf("password incorrect or archive is damaged")
+	}
+	err = json.Unmarshal(cr.NewCipher(bpasw).Decrypt(encd), content)
+	if err != nil {
+		return fmt.Errorf("json decode")
+	}
+	return nil
+}
+
+func newBackup(user *sr.User) *Backup {
+	var identities [][2]string
+	for _, identity := range user.Identities() {
+		identities = append(identities, [2]string{
+			identity.Name,
+			identity.Priv.String(),
+		})
+	}
+	backup := &Backup{
+		PrivKey:    user.Priv().String(),
+		Identities: identities,
+		F2F:        DATABASE.StateF2F(user),
+		Contacts:   DATABASE.GetContacts(user),
+		Connects:   DATABASE.GetConns(user),
+		Emails:     DATABASE.GetMailbox(user),
+		Deleted:    DATABASE.GetDeleted(user),
+	}
+	rotated := DATABASE.KeyRotated(user)
+	if oldpriv := user.OldPriv(); oldpriv != nil && !rotated.IsZero() {
+		backup.OldPrivKey = oldpriv.String()
+		backup.Rotated = rotated.Unix()
+	}
+	return backup
+}
+
+func restoreBackup(user *sr.User, backup *Backup) (int, string) {
+	var (
+		failed string
+	)
+	if backup.F2F != DATABASE.StateF2F(user) {
+		DATABASE.SwitchF2F(user)
+	}
+	// the grace period may be over since the backup
+	rotated := time.Unix(backup.Rotated, 0)
+	if backup.OldPrivKey != "" && rotated.Add(sr.KEYGRACE).After(time.Now()) {
+		err := DATABASE.SetOldKey(user, pr.LoadPrivKeyByString(backup.OldPrivKey), rotated)
+		if err != nil {
+			failed += fmt.Sprintf("old_priv_key='%s';\n", err.Error())
+		}
+	}
+	for _, identity := range backup.Identities {
+		err := DATABASE.SetIdentity(user, identity[0], pr.LoadPrivKeyByString(identity[1]))
+		if err != nil {
+			failed += fmt.Sprintf("%s='%s';\n", identity[0], err.Error())
+		}
+	}
+	retcod, result := importAddressBook(user, &AddressBook{
+		Contacts: backup.Contacts,
+		Connects: backup.Connects,
+	}, false)
+	for i := range backup.Emails {
+		err := DATABASE.RestoreEmail(user, &backup.Emails[i])
+		if err != nil {
+			failed += fmt.Sprintf("%s='%s';\n", backup.Emails[i].Hash, err.Error())
+		}
+	}
+	for _, pack := range backup.Deleted {
+		err := DATABASE.RestoreDeleted(user, pack)
+		if err != nil {
+			failed += fmt.Sprintf("%s='%s';\n", pack, err.Error())
+		}
+	}
+	if failed != "" {
+		return makeResult(RET_WARNING, result+"; "+failed)
+	}
+	return retcod, result
+}
+
+func importAddressBook(user *sr.User, book *AddressBook, replace bool) (int, string) {
+	var (
+		added     int
+		conflicts string
+	)
+	for _, contact := range book.Contacts {
+		err := DATABASE.ImportContact(user, contact, replace)
+		if err != nil {
+			conflicts += fmt.Sprintf("%s='%s';\n", contact.Name, err.Error())
+			continue
+		}
+		added++
+	}
+	for _, conn := range book.Connects {
+		err := DATABASE.SetConn(user, conn[0], conn[1])
+		if err != nil {
+			conflicts += fmt.Sprintf("%s='%s';\n", conn[0], err.Error())
+		}
+	}
+	result := fmt.Sprintf("success: %d of %d contacts imported", added, len(book.Contacts))
+	if conflicts != "" {
+		return makeResult(RET_WARNING, result+"; "+conflicts)
+	}
+	return makeResult(RET_SUCCESS, result)
+}
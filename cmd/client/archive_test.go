@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	lc "github.com/number571/go-peer/local"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+	sr "github.com/number571/hes/storage"
+)
+
+func TestMain(m *testing.M) {
+	hestest.Main(m)
+}
+
+func newTestDatabase(t *testing.T) {
+	DATABASE = sr.NewDB(filepath.Join(t.TempDir(), "hes.db"))
+	if DATABASE == nil {
+		t.Fatal("database is null")
+	}
+	if err := DATABASE.SetKDF(hestest.KDF); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	newTestDatabase(t)
+	content := AddressBook{
+		Contacts: []sr.Contact{{Name: "friend", Publ: "Pub(...){...}", Verified: true}},
+		Connects: [][2]string{{"http://localhost:8080", "pasw"}},
+	}
+	if _, err := packArchive("short", content); err == nil {
+		t.Fatal("archive with short password is packed")
+	}
+	archive, err := packArchive("password", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		pasw    string
+		archive []byte
+		ok      bool
+	}{
+		{"valid", "password", archive, true},
+		{"password", "password2", archive, false},
+		{"json", "password", archive[:len(archive)/2], false},
+		{"fields", "password", []byte(`{"kdf": "argon2id:1:1024:1", "salt": "", "hash": "", "data": ""}`), false},
+		{"kdf", "password", []byte(`{"kdf": "argon2id:1:4294967295:255", "salt": "c2FsdA==", "hash": "", "data": "ZGF0YQ=="}`), false},
+	}
+	for _, tt := range tests {
+		var book AddressBook
+		err := unpackArchive(tt.pasw, tt.archive, &book)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(book, content) {
+			t.Errorf("%s: content is changed", tt.name)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	newTestDatabase(t)
+	user := hestest.NewUser(t, DATABASE, "username", "password1", pr.NewPrivKey("x25519"))
+	friend := pr.NewPrivKey("x25519")
+	DATABASE.SetContact(user, "friend", friend.PubKey())
+	DATABASE.SetConn(user, "http://localhost:8080", "pasw")
+	DATABASE.SetIdentity(user, "identity", pr.NewPrivKey("x25519"))
+	kept := hestest.NewEmail(friend, user.Priv(), "head", "body")
+	deleted := hestest.NewEmail(friend, user.Priv(), "head", "body")
+	for _, pack := range []lc.Message{kept, deleted} {
+		if err := DATABASE.SetEmail(user, user.Priv().PubKey(), pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	DATABASE.DelEmail(user, DATABASE.GetEmailByPack(user, deleted).Hash)
+	oldpriv := user.Priv()
+	if err := DATABASE.RotateKey(user, pr.RenewPrivKey(oldpriv)); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := newBackup(user)
+	restored := hestest.NewUser(t, DATABASE, "username2", "password2", pr.LoadPrivKeyByString(backup.PrivKey))
+	if retcod, result := restoreBackup(restored, backup); retcod != RET_SUCCESS {
+		t.Fatal(result)
+	}
+	restored = DATABASE.GetUser("username2", "password2")
+	if restored.Priv().String() != user.Priv().String() {
+		t.Error("private key is not restored")
+	}
+	if restored.OldPriv() == nil || restored.OldPriv().String() != oldpriv.String() {
+		t.Error("old private key is not restored")
+	}
+	if len(restored.Identities()) != 1 || restored.Identities()[0].Name != "identity" {
+		t.Error("identity is not restored")
+	}
+	if !DATABASE.InContacts(restored, friend.PubKey()) || len(DATABASE.GetConns(restored)) != 1 {
+		t.Error("address book is not restored")
+	}
+	if DATABASE.GetEmailByPack(restored, kept) == nil {
+		t.Error("email is not restored")
+	}
+	if DATABASE.SetEmail(restored, restored.Priv().PubKey(), kept) == nil {
+		t.Error("restored email is saved again")
+	}
+	if DATABASE.SetEmail(restored, restored.Priv().PubKey(), deleted) == nil {
+		t.Error("deleted email is saved again")
+	}
+}
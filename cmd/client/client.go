@@ -2,35 +2,43 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"html/template"
+	"image"
+	_ "image/jpeg"
 	"image/png"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/qr"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
 	cr "github.com/number571/go-peer/crypto"
 	en "github.com/number571/go-peer/encoding"
 	lc "github.com/number571/go-peer/local"
 	gp "github.com/number571/go-peer/settings"
 
+	pr "github.com/number571/hes/protocol"
 	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
 )
 
 type TemplateResult struct {
 	Auth   string
+	CSRF   string
 	Result string
 	Return int
 }
 
 const (
-	FSEPARAT = "\001\007\005\000\005\007\001"
 	MAXEPAGE = 5 // view emails in one page
 	MAXCOUNT = 5 // load emails from one node
 )
@@ -47,41 +55,128 @@ const (
 )
 
 var (
-	DATABASE = NewDB("s-hes.db")
-	SESSIONS = NewSessions()
+	KDFPARAMS = flag.String("kdf", sr.KDFDEFAULT, "password hardening of new accounts and archives (argon2id:time:memory(KiB):threads)")
 )
 
-func init() {
-	go delOldSessionsByTime(1*time.Hour, 15*time.Minute)
-	st.HesDefaultInit("localhost:7545")
-	fmt.Printf("Client is listening [%s] ...\n\n", st.OPENADDR)
-}
+var (
+	DATABASE *sr.DB
+	SESSIONS *Sessions
+	EVENTS   *Events
+)
 
-func delOldSessionsByTime(deltime, period time.Duration) {
+func delOldSessionsByTime(period time.Duration) {
 	for {
-		SESSIONS.DelByTime(deltime)
+		SESSIONS.DelByTime()
+		DATABASE.DelOldKeys()
 		time.Sleep(period)
 	}
 }
 
 func main() {
+	st.HesDefaultInit("localhost:7545")
+	DATABASE = sr.NewDB("s-hes.db")
+	if DATABASE == nil {
+		fmt.Println("error: load database")
+		os.Exit(1)
+	}
+	err := DATABASE.SetKDF(*KDFPARAMS)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	SESSIONS = NewSessions()
+	EVENTS = NewEvents()
+	go delOldSessionsByTime(1 * time.Minute)
+	fmt.Printf("Client is listening [%s] ...\n\n", st.OPENADDR)
 	http.Handle("/static/", http.StripPrefix(
 		"/static/",
 		handleFileServer(http.Dir(PATH_STATIC))),
 	)
 	http.HandleFunc("/", indexPage)
-	http.HandleFunc("/account", accountPage)
-	http.HandleFunc("/account/public_key", accountPublicKeyPage)
-	http.HandleFunc("/account/private_key", accountPrivateKeyPage)
-	http.HandleFunc("/signup", signupPage)
-	http.HandleFunc("/signin", signinPage)
+	http.HandleFunc("/account", checkCSRF(accountPage))
+	http.HandleFunc("/account/public_key", checkCSRF(accountPublicKeyPage))
+	http.HandleFunc("/account/private_key", checkCSRF(accountPrivateKeyPage))
+	http.HandleFunc("/signup", checkCSRF(signupPage))
+	http.HandleFunc("/signin", checkCSRF(signinPage))
 	http.HandleFunc("/signout", signoutPage)
-	http.HandleFunc("/network", networkPage)
-	http.HandleFunc("/network/read", networkReadPage)
-	http.HandleFunc("/network/write", networkWritePage)
-	http.HandleFunc("/network/contact", networkContactPage)
-	http.HandleFunc("/network/connect", networkConnectPage)
-	http.ListenAndServe(st.OPENADDR, nil)
+	http.HandleFunc("/network", checkCSRF(networkPage))
+	http.HandleFunc("/network/read", checkCSRF(networkReadPage))
+	http.HandleFunc("/network/write", checkCSRF(networkWritePage))
+	http.HandleFunc("/network/contact", checkCSRF(networkContactPage))
+	http.HandleFunc("/network/connect", checkCSRF(networkConnectPage))
+	http.HandleFunc("/network/events", networkEventsPage)
+	handleAPI()
+	err = checkListenAddr(st.OPENADDR)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	err = checkHookURL(*HOOKURL)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	err = checkHookCmd(*HOOKCMD)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *SMTPADDR != "" {
+		err = listenMail(*SMTPADDR, serveSMTP)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *POP3ADDR != "" {
+		err = listenMail(*POP3ADDR, servePOP3)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	handler := guardHandler(st.OPENADDR, holdSessions(http.DefaultServeMux))
+	if *USETLS {
+		err = loadCertificate(st.OPENADDR)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		*SESSSECURE = true
+		http.ListenAndServeTLS(st.OPENADDR, PATH_CERT, PATH_KEY, handler)
+		return
+	}
+	http.ListenAndServe(st.OPENADDR, handler)
+}
+
+// Every POST of a session must contain the token of the session.
+func checkCSRF(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			handler(w, r)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.ParseMultipartForm(int64(st.SETTINGS.Get(gp.SizePack)))
+		}
+		if SESSIONS.CheckToken(r, r.FormValue("csrf_token")) {
+			handler(w, r)
+			return
+		}
+		t, err := template.ParseFiles(
+			PATH_VIEWS+"base.html",
+			PATH_VIEWS+"error.html",
+		)
+		if err != nil {
+			panic("error: load error.html")
+		}
+		w.WriteHeader(http.StatusForbidden)
+		t.Execute(w, TemplateResult{
+			Auth:   getName(SESSIONS.Get(r)),
+			Result: "error: request is not confirmed by the session (csrf token)",
+			Return: RET_DANGER,
+		})
+	}
 }
 
 func handleFileServer(fs http.FileSystem) http.Handler {
@@ -108,6 +203,13 @@ func indexPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func signupPage(w http.ResponseWriter, r *http.Request) {
+	type SignupTemplateResult struct {
+		TemplateResult
+		Username   string
+		PrivateKey string
+		KeyTypes   []string
+	}
+	var username, privkey string
 	retcod, result := makeResult(RET_SUCCESS, "")
 	t, err := template.ParseFiles(
 		PATH_VIEWS+"base.html",
@@ -120,11 +222,75 @@ func signupPage(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if r.Method == "POST" && r.FormValue("restore") != "" {
+		var backup Backup
+		name := r.FormValue("username")
+		pasw := r.FormValue("password")
+		username = name
+		if pasw != r.FormValue("password_repeat") {
+			retcod, result = makeResult(RET_DANGER, "error: passwords not equal")
+			goto close
+		}
+		data, err := readFile(r, "backup")
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		err = unpackArchive(r.FormValue("backup_password"), data, &backup)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		priv := pr.LoadPrivKeyByString(backup.PrivKey)
+		if priv == nil {
+			retcod, result = makeResult(RET_DANGER, "error: private key is not valid")
+			goto close
+		}
+		err = DATABASE.SetUser(name, pasw, priv)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		user := DATABASE.GetUser(name, pasw)
+		if user == nil {
+			retcod, result = makeResult(RET_DANGER, "error: user is not created")
+			goto close
+		}
+		defer DATABASE.WipeUser(user)
+		// the account is created only if the backup is fully restored
+		retcod, result = restoreBackup(user, &backup)
+		if retcod != RET_SUCCESS {
+			DATABASE.DelUser(user)
+			result = "error: account is not created; " + result
+			goto close
+		}
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	if r.Method == "POST" && r.FormValue("loadqr") != "" {
+		username = r.FormValue("username")
+		spriv, err := readQRCode(r, "qrcode")
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		if pr.LoadPrivKeyByString(spriv) == nil {
+			retcod, result = makeResult(RET_DANGER, "error: private key is not valid")
+			goto close
+		}
+		privkey = spriv
+		result = "success: private key loaded"
+		goto close
+	}
 	if r.Method == "POST" {
 		name := r.FormValue("username")
 		pasw := r.FormValue("password")
 		spriv := r.FormValue("private_key")
-		priv := cr.LoadPrivKeyByString(spriv)
+		priv := pr.LoadPrivKeyByString(spriv)
 		if pasw != r.FormValue("password_repeat") {
 			retcod, result = makeResult(RET_DANGER, "error: passwords not equal")
 			goto close
@@ -134,7 +300,11 @@ func signupPage(w http.ResponseWriter, r *http.Request) {
 			goto close
 		}
 		if priv == nil {
-			priv = cr.NewPrivKey(st.AKEYSIZE)
+			priv = pr.NewPrivKey(r.FormValue("key_type"))
+		}
+		if priv == nil {
+			retcod, result = makeResult(RET_DANGER, "error: key type is not supported")
+			goto close
 		}
 		err := DATABASE.SetUser(name, pasw, priv)
 		if err != nil {
@@ -146,9 +316,15 @@ func signupPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 close:
-	t.Execute(w, TemplateResult{
-		Result: result,
-		Return: retcod,
+	t.Execute(w, SignupTemplateResult{
+		TemplateResult: TemplateResult{
+			CSRF:   SESSIONS.Token(r),
+			Result: result,
+			Return: retcod,
+		},
+		Username:   username,
+		PrivateKey: privkey,
+		KeyTypes:   pr.KEYTYPES,
 	})
 }
 
@@ -173,7 +349,20 @@ func signinPage(w http.ResponseWriter, r *http.Request) {
 			retcod, result = makeResult(RET_DANGER, "error: username of password incorrect")
 			goto close
 		}
-		SESSIONS.Set(w, user)
+		if !DATABASE.CheckTOTP(user, r.FormValue("code")) {
+			DATABASE.WipeUser(user)
+			retcod, result = makeResult(RET_DANGER, "error: two-factor code incorrect")
+			goto close
+		}
+		user = SESSIONS.Share(user)
+		defer SESSIONS.Release(user)
+		err := DATABASE.UpgradeKDF(user, pasw)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		SESSIONS.Set(w, r, user)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -194,9 +383,21 @@ func accountPage(w http.ResponseWriter, r *http.Request) {
 		TemplateResult
 		PublicKey  string
 		PrivateKey string
-	}
+		Identities []sr.Identity
+		TOTP       bool
+		TOTPSecret string
+		TOTPImage  string
+		Recovery   []string
+		Sessions   []Session
+	}
+	var (
+		totpSecret string
+		recovery   []string
+	)
 	retcod, result := makeResult(RET_SUCCESS, "")
-	t, err := template.ParseFiles(
+	t, err := template.New("base.html").Funcs(template.FuncMap{
+		"fingerprint": getFingerprint,
+	}).ParseFiles(
 		PATH_VIEWS+"base.html",
 		PATH_VIEWS+"account.html",
 	)
@@ -208,16 +409,135 @@ func accountPage(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if r.Method == "POST" && r.FormValue("change") != "" {
+		pasw := r.FormValue("new_password")
+		if !checkPassword(user, user.Name, r.FormValue("old_password")) {
+			retcod, result = makeResult(RET_DANGER, "error: password incorrect")
+			goto close
+		}
+		if pasw != r.FormValue("new_password_repeat") {
+			retcod, result = makeResult(RET_DANGER, "error: passwords not equal")
+			goto close
+		}
+		err := DATABASE.ChangePassword(user, pasw)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		SESSIONS.DelOthers(r, user)
+		result = "success: password changed, other sessions closed"
+	}
+	if r.Method == "POST" && r.FormValue("rotate") != "" {
+		if !checkPassword(user, user.Name, r.FormValue("password")) {
+			retcod, result = makeResult(RET_DANGER, "error: password incorrect")
+			goto close
+		}
+		oldpriv := user.Priv()
+		newpriv := pr.RenewPrivKey(oldpriv)
+		err := DATABASE.RotateKey(user, newpriv)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		SESSIONS.Go(user, func() { announceKey(user, oldpriv, newpriv) })
+		result = "success: key rotated, contacts will be notified"
+	}
+	if r.Method == "POST" && r.FormValue("session_revoke") != "" {
+		if !SESSIONS.Revoke(user, r.FormValue("session_id")) {
+			retcod, result = makeResult(RET_DANGER, "error: session not found")
+			goto close
+		}
+		if SESSIONS.Get(r) == nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		result = "success: session closed"
+	}
+	if r.Method == "POST" && r.FormValue("totp_setup") != "" {
+		totpSecret = sr.NewTOTPSecret()
+		result = "success: scan the QR code and enter the code"
+	}
+	if r.Method == "POST" && r.FormValue("totp_enable") != "" {
+		secret := r.FormValue("totp_secret")
+		if sr.CheckTOTP(secret, r.FormValue("code"), 0) == 0 {
+			totpSecret = secret
+			retcod, result = makeResult(RET_DANGER, "error: two-factor code incorrect")
+			goto close
+		}
+		codes := sr.NewRecoveryCodes()
+		err := DATABASE.SetTOTP(user, secret, codes)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		recovery = codes
+		result = "success: two-factor enabled, save the recovery codes"
+	}
+	if r.Method == "POST" && r.FormValue("totp_disable") != "" {
+		if !checkPassword(user, user.Name, r.FormValue("password")) {
+			retcod, result = makeResult(RET_DANGER, "error: password incorrect")
+			goto close
+		}
+		err := DATABASE.DelTOTP(user)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		result = "success: two-factor disabled"
+	}
+	if r.Method == "POST" && r.FormValue("identity_append") != "" {
+		var priv cr.PrivKey
+		spriv := strings.TrimSpace(r.FormValue("identity_private_key"))
+		if spriv == "" {
+			priv = pr.RenewPrivKey(user.Priv())
+		} else {
+			priv = pr.LoadPrivKeyByString(spriv)
+		}
+		if priv == nil {
+			retcod, result = makeResult(RET_DANGER, "error: private key is null")
+			goto close
+		}
+		err := DATABASE.SetIdentity(user, r.FormValue("identity_name"), priv)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		result = "success: identity append"
+	}
+	if r.Method == "POST" && r.FormValue("identity_delete") != "" {
+		err := DATABASE.DelIdentity(user, pr.LoadPubKeyByString(r.FormValue("identity_public_key")))
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		result = "success: identity deleted"
+	}
+	if r.Method == "POST" && r.FormValue("backup") != "" {
+		data, err := packArchive(r.FormValue("backup_password"), newBackup(user))
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"account.hes\"")
+		w.Write(data)
+		return
+	}
 	if r.Method == "POST" && r.FormValue("delete") != "" {
-		name := r.FormValue("username")
-		pasw := r.FormValue("password")
-		cuser := DATABASE.GetUser(name, pasw)
-		if cuser == nil || cuser.Id != user.Id {
+		if !checkPassword(user, r.FormValue("username"), r.FormValue("password")) {
 			retcod, result = makeResult(RET_DANGER, "error: username of password incorrect")
 			goto close
 		}
+		SESSIONS.DelOthers(r, user)
 		SESSIONS.Del(w, r)
-		DATABASE.DelUser(cuser)
+		DATABASE.DelUser(user)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -225,11 +545,18 @@ close:
 	t.Execute(w, AccountTemplateResult{
 		TemplateResult: TemplateResult{
 			Auth:   getName(SESSIONS.Get(r)),
+			CSRF:   SESSIONS.Token(r),
 			Result: result,
 			Return: retcod,
 		},
-		PublicKey:  user.Priv.PubKey().String(),
-		PrivateKey: user.Priv.String(),
+		PublicKey:  user.Priv().PubKey().String(),
+		PrivateKey: user.Priv().String(),
+		Identities: user.Identities(),
+		TOTP:       DATABASE.StateTOTP(user),
+		TOTPSecret: totpSecret,
+		TOTPImage:  getTOTPImage(user.Name, totpSecret),
+		Recovery:   recovery,
+		Sessions:   SESSIONS.List(r, user),
 	})
 }
 
@@ -239,7 +566,7 @@ func accountPublicKeyPage(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "error: session is null")
 		return
 	}
-	dataString := user.Priv.PubKey().String()
+	dataString := user.Priv().PubKey().String()
 	qrCode, err := qr.Encode(dataString, qr.Q, qr.Auto)
 	if err != nil {
 		fmt.Fprint(w, "error: qrcode generate")
@@ -259,7 +586,7 @@ func accountPrivateKeyPage(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "error: session is null")
 		return
 	}
-	dataString := user.Priv.String()
+	dataString := user.Priv().String()
 	qrCode, err := qr.Encode(dataString, qr.L, qr.Auto)
 	if err != nil {
 		fmt.Fprint(w, "error: qrcode generate")
@@ -277,7 +604,7 @@ func networkPage(w http.ResponseWriter, r *http.Request) {
 	type ReadTemplateResult struct {
 		TemplateResult
 		Page   int
-		Emails []Email
+		Emails []sr.Email
 	}
 	page := 0
 	retcod, result := makeResult(RET_SUCCESS, "")
@@ -310,10 +637,29 @@ func networkPage(w http.ResponseWriter, r *http.Request) {
 		hash := r.FormValue("email")
 		DATABASE.DelEmail(user, hash)
 	}
+	if r.Method == "POST" && r.FormValue("export_eml") != "" {
+		email := DATABASE.GetEmailByHash(user, r.FormValue("email"))
+		if email == nil {
+			retcod, result = makeResult(RET_DANGER, "error: email undefined")
+			goto close
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"email.eml\"")
+		w.Write(newEML(email))
+		return
+	}
+	if r.Method == "POST" && r.FormValue("export_mbox") != "" {
+		w.Header().Set("Content-Type", "application/mbox")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"mailbox.mbox\"")
+		w.Write(newMbox(DATABASE.GetMailbox(user)))
+		return
+	}
 	if r.Method == "POST" && r.FormValue("update") != "" {
-		conns := DATABASE.GetConns(user)
-		for _, conn := range conns {
-			go readEmails(user, conn[0])
+		SESSIONS.Go(user, func() { fetchEmails(user) })
+		// the page is updated by the events
+		if r.FormValue("async") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 		time.Sleep(3 * time.Second)
 	}
@@ -321,6 +667,7 @@ close:
 	t.Execute(w, ReadTemplateResult{
 		TemplateResult: TemplateResult{
 			Auth:   getName(SESSIONS.Get(r)),
+			CSRF:   SESSIONS.Token(r),
 			Result: result,
 			Return: retcod,
 		},
@@ -329,21 +676,19 @@ close:
 	})
 }
 
-// FS = FSEPARAT
+// FS = pr.FSEPARAT
 // head = title   || FS || filename[0]     || ... || FS || filename[n]
 // body = message || FS || base64(file[0]) || ... || FS || base64(file[n])
 func networkWritePage(w http.ResponseWriter, r *http.Request) {
 	type WriteTemplateResult struct {
 		TemplateResult
-		Contacts map[string]string
-	}
-	type Req struct {
-		Recv string `json:"recv"`
-		Data string `json:"data"`
-		Macp string `json:"macp"`
+		Identities []sr.Identity
+		Contacts   []sr.Contact
 	}
 	retcod, result := makeResult(RET_SUCCESS, "")
-	t, err := template.ParseFiles(
+	t, err := template.New("base.html").Funcs(template.FuncMap{
+		"fingerprint": getFingerprint,
+	}).ParseFiles(
 		PATH_VIEWS+"base.html",
 		PATH_VIEWS+"write.html",
 	)
@@ -361,11 +706,16 @@ func networkWritePage(w http.ResponseWriter, r *http.Request) {
 			retcod, result = makeResult(RET_DANGER, "error: max size")
 			goto close
 		}
-		recv := cr.LoadPubKeyByString(r.FormValue("receiver"))
+		recv := pr.LoadPubKeyByString(r.FormValue("receiver"))
 		if recv == nil {
 			retcod, result = makeResult(RET_DANGER, "error: receiver is null")
 			goto close
 		}
+		sender := getIdentity(user, r.FormValue("sender"))
+		if sender == nil {
+			retcod, result = makeResult(RET_DANGER, "error: sender is null")
+			goto close
+		}
 		head := strings.TrimSpace(r.FormValue("title"))
 		body := strings.TrimSpace(r.FormValue("message"))
 		if head == "" || body == "" {
@@ -385,29 +735,19 @@ func networkWritePage(w http.ResponseWriter, r *http.Request) {
 				goto close
 			}
 			file.Close()
-			head += FSEPARAT + files[i].Filename
-			body += FSEPARAT + en.Base64Encode(content)
+			head += pr.FSEPARAT + files[i].Filename
+			body += pr.FSEPARAT + en.Base64Encode(content)
 		}
-		client := lc.NewClient(user.Priv, st.SETTINGS)
-		pack, _ := client.Encrypt(
-			lc.NewRoute(recv, nil, nil),
-			newEmail(user.Name, head, body),
-		)
-		hash := pack.Body.Hash
-		conns := DATABASE.GetConns(user)
-		req := Req{
-			Recv: string(recv.Address()),
-			Data: string(pack.Serialize()),
-		}
-		if uint64(len(req.Data)) > st.SETTINGS.Get(gp.SizePack) {
-			retcod, result = makeResult(RET_DANGER, "error: max size")
+		err = sendMessage(user, sender.Priv, recv, pr.NewEmail(sender.Name, head, body))
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
 			goto close
 		}
-		for _, conn := range conns {
-			pasw := cr.NewHasher([]byte(conn[1])).Bytes()
-			cipher := cr.NewCipher(pasw)
-			req.Macp = en.Base64Encode(cipher.Encrypt(hash))
-			go writeEmails(conn[0], st.Serialize(req))
+		if !DATABASE.IsVerified(user, recv) {
+			retcod, result = makeResult(RET_WARNING,
+				"success: email send (warning: receiver's key is not verified)")
+			goto close
 		}
 		result = "success: email send"
 	}
@@ -415,23 +755,26 @@ close:
 	t.Execute(w, WriteTemplateResult{
 		TemplateResult: TemplateResult{
 			Auth:   getName(SESSIONS.Get(r)),
+			CSRF:   SESSIONS.Token(r),
 			Result: result,
 			Return: retcod,
 		},
-		Contacts: DATABASE.GetContacts(user),
+		Identities: getIdentities(user),
+		Contacts:   DATABASE.GetContacts(user),
 	})
 }
 
 func networkReadPage(w http.ResponseWriter, r *http.Request) {
 	type ReadTemplateResult struct {
 		TemplateResult
-		Email *Email
+		Email *sr.Email
 	}
 	retcod, result := makeResult(RET_SUCCESS, "")
 	t, err := template.New("base.html").Funcs(template.FuncMap{
-		"split": strings.Split,
-		"texts": getTexts,
-		"files": getFiles,
+		"split":       strings.Split,
+		"texts":       getTexts,
+		"files":       getFiles,
+		"fingerprint": getFingerprint,
 	}).ParseFiles(
 		PATH_VIEWS+"base.html",
 		PATH_VIEWS+"read.html",
@@ -446,7 +789,7 @@ func networkReadPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method == "POST" {
-		pub := cr.LoadPubKeyByString(r.FormValue("public_key"))
+		pub := pr.LoadPubKeyByString(r.FormValue("public_key"))
 		if pub == nil {
 			fmt.Fprint(w, "error: public key is null")
 			return
@@ -465,7 +808,7 @@ func networkReadPage(w http.ResponseWriter, r *http.Request) {
 		png.Encode(w, qrCode)
 		return
 	}
-	var email *Email
+	var email *sr.Email
 	id, err := strconv.Atoi(r.FormValue("email"))
 	if err != nil {
 		retcod, result = makeResult(RET_DANGER, "error: atoi parse")
@@ -480,6 +823,7 @@ close:
 	t.Execute(w, ReadTemplateResult{
 		TemplateResult: TemplateResult{
 			Auth:   getName(SESSIONS.Get(r)),
+			CSRF:   SESSIONS.Token(r),
 			Result: result,
 			Return: retcod,
 		},
@@ -490,11 +834,17 @@ close:
 func networkContactPage(w http.ResponseWriter, r *http.Request) {
 	type ContactTemplateResult struct {
 		TemplateResult
-		F2F      bool
-		Contacts map[string]string
+		F2F       bool
+		Contacts  []sr.Contact
+		Rotations []sr.Rotation
+		Nickname  string
+		PublicKey string
 	}
+	var nickname, pubkey string
 	retcod, result := makeResult(RET_SUCCESS, "")
-	t, err := template.ParseFiles(
+	t, err := template.New("base.html").Funcs(template.FuncMap{
+		"fingerprint": getFingerprint,
+	}).ParseFiles(
 		PATH_VIEWS+"base.html",
 		PATH_VIEWS+"contact.html",
 	)
@@ -509,9 +859,25 @@ func networkContactPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" && r.FormValue("switchf2f") != "" {
 		DATABASE.SwitchF2F(user)
 	}
+	if r.Method == "POST" && r.FormValue("loadqr") != "" {
+		nickname = r.FormValue("nickname")
+		spub, err := readQRCode(r, "qrcode")
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		if pr.LoadPubKeyByString(spub) == nil {
+			retcod, result = makeResult(RET_DANGER, "error: public key is not valid")
+			goto close
+		}
+		pubkey = spub
+		result = "success: public key loaded"
+		goto close
+	}
 	if r.Method == "POST" && r.FormValue("append") != "" {
 		name := r.FormValue("nickname")
-		publ := cr.LoadPubKeyByString(r.FormValue("public_key"))
+		publ := pr.LoadPubKeyByString(r.FormValue("public_key"))
 		err := DATABASE.SetContact(user, name, publ)
 		if err != nil {
 			retcod, result = makeResult(RET_DANGER,
@@ -519,8 +885,70 @@ func networkContactPage(w http.ResponseWriter, r *http.Request) {
 			goto close
 		}
 	}
+	if r.Method == "POST" && r.FormValue("export") != "" {
+		book := AddressBook{
+			Contacts: DATABASE.GetContacts(user),
+		}
+		if r.FormValue("with_connects") != "" {
+			book.Connects = DATABASE.GetConns(user)
+		}
+		data, err := packArchive(r.FormValue("password"), book)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"contacts.hes\"")
+		w.Write(data)
+		return
+	}
+	if r.Method == "POST" && r.FormValue("import") != "" {
+		var book AddressBook
+		data, err := readFile(r, "archive")
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		err = unpackArchive(r.FormValue("password"), data, &book)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		retcod, result = importAddressBook(user, &book, r.FormValue("replace") != "")
+	}
+	if r.Method == "POST" && r.FormValue("rotation_accept") != "" {
+		publ := pr.LoadPubKeyByString(r.FormValue("public_key"))
+		err := DATABASE.AcceptRotation(user, publ)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+		result = "success: contact key updated"
+	}
+	if r.Method == "POST" && r.FormValue("rotation_reject") != "" {
+		publ := pr.LoadPubKeyByString(r.FormValue("public_key"))
+		err := DATABASE.DelRotation(user, publ)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+	}
+	if r.Method == "POST" && r.FormValue("verify") != "" {
+		publ := pr.LoadPubKeyByString(r.FormValue("public_key"))
+		err := DATABASE.SwitchVerified(user, publ)
+		if err != nil {
+			retcod, result = makeResult(RET_DANGER,
+				fmt.Sprintf("error: %s", err.Error()))
+			goto close
+		}
+	}
 	if r.Method == "POST" && r.FormValue("delete") != "" {
-		publ := cr.LoadPubKeyByString(r.FormValue("public_key"))
+		publ := pr.LoadPubKeyByString(r.FormValue("public_key"))
 		err := DATABASE.DelContact(user, publ)
 		if err != nil {
 			retcod, result = makeResult(RET_DANGER,
@@ -532,11 +960,15 @@ close:
 	t.Execute(w, ContactTemplateResult{
 		TemplateResult: TemplateResult{
 			Auth:   getName(SESSIONS.Get(r)),
+			CSRF:   SESSIONS.Token(r),
 			Result: result,
 			Return: retcod,
 		},
-		F2F:      DATABASE.StateF2F(user),
-		Contacts: DATABASE.GetContacts(user),
+		F2F:       DATABASE.StateF2F(user),
+		Contacts:  DATABASE.GetContacts(user),
+		Rotations: DATABASE.GetRotations(user),
+		Nickname:  nickname,
+		PublicKey: pubkey,
 	})
 }
 
@@ -595,6 +1027,7 @@ close:
 	t.Execute(w, ConnTemplateResult{
 		TemplateResult: TemplateResult{
 			Auth:   getName(SESSIONS.Get(r)),
+			CSRF:   SESSIONS.Token(r),
 			Result: result,
 			Return: retcod,
 		},
@@ -602,185 +1035,189 @@ close:
 	})
 }
 
+// Password is checked by a new user of the account,
+// the user is wiped after the check.
+func checkPassword(user *sr.User, name, pasw string) bool {
+	cuser := DATABASE.GetUser(name, pasw)
+	if cuser == nil {
+		return false
+	}
+	defer DATABASE.WipeUser(cuser)
+	return cuser.Id == user.Id
+}
+
 func checkConnection(conn [2]string) (int, string) {
-	type Resp struct {
-		Result string `json:"result"`
-		Return int    `json:"return"`
-	}
-	type Req struct {
-		Macp string `json:"macp"`
-	}
-	var servresp Resp
-	pasw := cr.NewHasher([]byte(conn[1])).Bytes()
-	cipher := cr.NewCipher(pasw)
-	macp := cipher.Encrypt(en.Uint64ToBytes(st.SETTINGS.Get(gp.MaskRout)))
-	resp, err := st.HTCLIENT.Post(
-		strings.TrimRight(conn[0], " /")+"/",
-		"application/json",
-		bytes.NewReader(st.Serialize(Req{
-			Macp: en.Base64Encode(macp),
-		})),
-	)
-	if err != nil {
-		return makeResult(RET_DANGER,
-			fmt.Sprintf("%s='%s';\n", conn[0], "error: connect"))
-	}
-	if resp.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
-		return makeResult(RET_DANGER,
-			fmt.Sprintf("%s='%s';\n", conn[0], "error: max size"))
-	}
-	err = json.NewDecoder(resp.Body).Decode(&servresp)
-	resp.Body.Close()
+	err := pr.Check(context.Background(), st.HTCLIENT, conn)
 	if err != nil {
 		return makeResult(RET_DANGER,
-			fmt.Sprintf("%s='%s';\n", conn[0], "error: parse json"))
-	}
-	if servresp.Return != 0 {
-		return makeResult(RET_DANGER,
-			fmt.Sprintf("%s='%s';\n", conn[0], servresp.Result))
+			fmt.Sprintf("%s='error: %s';\n", conn[0], err.Error()))
 	}
 	return makeResult(RET_SUCCESS, "")
 }
 
-func writeEmails(addr string, rdata []byte) {
-	type Resp struct {
-		Result string `json:"result"`
-		Return int    `json:"return"`
-	}
-	var servresp Resp
-	resp, err := st.HTCLIENT.Post(
-		strings.TrimRight(addr, " /")+"/email/send",
-		"application/json",
-		bytes.NewReader(rdata),
-	)
+func readFile(r *http.Request, field string) ([]byte, error) {
+	err := r.ParseMultipartForm(int64(st.SETTINGS.Get(gp.SizePack)))
 	if err != nil {
-		return
-	}
-	if resp.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
-		return
+		return nil, fmt.Errorf("max size")
 	}
-	err = json.NewDecoder(resp.Body).Decode(&servresp)
-	resp.Body.Close()
+	file, _, err := r.FormFile(field)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("file is null")
 	}
-	if servresp.Return != 0 {
-		return
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("read file")
 	}
+	return data, nil
 }
 
-func readEmails(user *User, addr string) {
-	type Resp struct {
-		Result string `json:"result"`
-		Return int    `json:"return"`
-	}
-	type Req struct {
-		Recv string `json:"recv"`
-		Data int    `json:"data"`
-	}
-	var servresp Resp
-	client := lc.NewClient(user.Priv, st.SETTINGS)
-	pbhash := string(client.PubKey().Address())
-	// GET SIZE EMAILS
-	resp, err := st.HTCLIENT.Post(
-		strings.TrimRight(addr, " /")+"/email/recv",
-		"application/json",
-		bytes.NewReader(st.Serialize(Req{
-			Recv: pbhash,
-			Data: 0,
-		})),
-	)
+func readQRCode(r *http.Request, field string) (string, error) {
+	data, err := readFile(r, field)
 	if err != nil {
-		return
+		return "", err
 	}
-	if resp.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
-		return
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("qrcode image is not png or jpeg")
 	}
-	err = json.NewDecoder(resp.Body).Decode(&servresp)
-	resp.Body.Close()
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
 	if err != nil {
-		return
+		return "", fmt.Errorf("qrcode image read")
 	}
-	if servresp.Return != 0 {
-		return
+	res, err := qrcode.NewQRCodeReader().Decode(bmp, nil)
+	if err != nil {
+		return "", fmt.Errorf("qrcode not found")
 	}
-	// GET DATA EMAILS
-	size, err := strconv.Atoi(servresp.Result)
+	return strings.TrimSpace(res.GetText()), nil
+}
+
+// The message is encrypted by the private key and
+// sent to the receiver through all connections.
+func sendMessage(user *sr.User, priv cr.PrivKey, recv cr.PubKey, msg lc.Message) error {
+	pack, err := pr.NewPackage(priv, recv, msg)
 	if err != nil {
-		return
+		return err
 	}
-	for i, count := 1, 0; i <= size; i++ {
-		resp, err := st.HTCLIENT.Post(
-			strings.TrimRight(addr, " /")+"/email/recv",
-			"application/json",
-			bytes.NewReader(st.Serialize(Req{
-				Recv: pbhash,
-				Data: i,
-			})),
-		)
-		if err != nil {
-			break
-		}
-		if resp.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
-			break
-		}
-		err = json.NewDecoder(resp.Body).Decode(&servresp)
-		resp.Body.Close()
-		if err != nil {
-			break
-		}
-		if servresp.Return != 0 {
-			continue
-		}
-		pack := lc.Package(servresp.Result).Deserialize()
-		if pack == nil {
-			continue
-		}
-		pack = client.Decrypt(pack)
-		if pack == nil {
+	sendPackage(user, recv, pack)
+	return nil
+}
+
+// Delivery to every node is sent to the pages of the user.
+func sendPackage(user *sr.User, recv cr.PubKey, pack lc.Message) {
+	for _, conn := range DATABASE.GetConns(user) {
+		go func(conn [2]string) {
+			status := map[string]string{"node": conn[0]}
+			err := pr.Send(context.Background(), st.HTCLIENT, conn, recv, pack)
+			if err != nil {
+				status["error"] = err.Error()
+			}
+			EVENTS.Publish(user.Id, "send", status)
+		}(conn)
+	}
+}
+
+// Every contact receives the new public key
+// in a message signed by the old private key.
+func announceKey(user *sr.User, oldpriv, newpriv cr.PrivKey) {
+	for _, contact := range DATABASE.GetContacts(user) {
+		recv := pr.LoadPubKeyByString(contact.Publ)
+		if recv == nil {
 			continue
 		}
-		err = DATABASE.SetEmail(user, pack)
-		if err == nil {
-			count++
-		}
-		if count == MAXCOUNT {
-			break
+		sendMessage(user, oldpriv, recv, pr.NewRotation(oldpriv, newpriv))
+	}
+}
+
+// Emails are loaded for the old key too
+// during the grace period after rotation
+// and for every identity of the user.
+// Progress is sent to the pages of the user.
+func fetchEmails(user *sr.User) []FetchResult {
+	var wg sync.WaitGroup
+	conns := DATABASE.GetConns(user)
+	results := make([]FetchResult, len(conns))
+	EVENTS.Publish(user.Id, "fetch", map[string]interface{}{
+		"status": "start",
+		"nodes":  len(conns),
+	})
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i].Node = addr
+			count, err := readEmails(user, addr)
+			results[i].Emails = count
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+			EVENTS.Publish(user.Id, "fetch", map[string]interface{}{
+				"status": "node",
+				"node":   addr,
+			})
+		}(i, conn[0])
+	}
+	wg.Wait()
+	EVENTS.Publish(user.Id, "fetch", map[string]interface{}{
+		"status": "done",
+		"nodes":  len(conns),
+	})
+	return results
+}
+
+func readEmails(user *sr.User, addr string) (int, error) {
+	return DATABASE.LoadEmails(context.Background(), st.HTCLIENT, user, addr, MAXCOUNT, func(email *sr.Email) {
+		EVENTS.Publish(user.Id, "email", map[string]string{
+			"hash":        email.Hash,
+			"sender_name": email.SenderName,
+			"contact":     email.Contact,
+			"identity":    email.Identity,
+		})
+		go runHooks(user, email)
+	})
+}
+
+// The main key goes first under the account name.
+func getIdentities(user *sr.User) []sr.Identity {
+	identities := []sr.Identity{{Name: user.Name, Priv: user.Priv()}}
+	return append(identities, user.Identities()...)
+}
+
+func getIdentity(user *sr.User, spub string) *sr.Identity {
+	for _, identity := range getIdentities(user) {
+		if identity.Priv.PubKey().String() == spub {
+			return &identity
 		}
 	}
+	return nil
 }
 
-func getTexts(email *Email) [2]string {
-	head := strings.Split(email.Head, FSEPARAT)[0]
-	body := strings.Split(email.Body, FSEPARAT)[0]
+func getTexts(email *sr.Email) [2]string {
 	return [2]string{
-		head,
-		body,
+		email.Head,
+		email.Body,
 	}
 }
 
-func getFiles(email *Email) [][2]string {
-	var list [][2]string
-	name := strings.Split(email.Head, FSEPARAT)[1:]
-	data := strings.Split(email.Body, FSEPARAT)[1:]
-	for i := range name {
-		list = append(list, [2]string{
-			name[i],
-			data[i],
-		})
-	}
-	return list
+func getFiles(email *sr.Email) [][2]string {
+	return email.Files
 }
 
-func newEmail(sender, head, body string) lc.Message {
-	return lc.NewMessage([]byte(IS_EMAIL), st.Serialize(Email{
-		SenderName: sender,
-		Head:       head,
-		Body:       body,
-	}))
+// fingerprint = hex(hash(public_key))[:32] in groups of four
+func getFingerprint(spub string) string {
+	pub := pr.LoadPubKeyByString(spub)
+	if pub == nil {
+		return ""
+	}
+	var groups []string
+	hash := fmt.Sprintf("%X", cr.NewHasher(pub.Bytes()).Bytes()[:16])
+	for i := 0; i < len(hash); i += 4 {
+		groups = append(groups, hash[i:i+4])
+	}
+	return strings.Join(groups, " ")
 }
 
-func getName(user *User) string {
+func getName(user *sr.User) string {
 	if user == nil {
 		return ""
 	}
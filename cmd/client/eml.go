@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+
+	sr "github.com/number571/hes/storage"
+)
+
+const (
+	EMLDOMAIN = "hes"
+)
+
+// Emails are converted to RFC 5322 messages,
+// addresses are names of contacts and identities,
+// so the answer can be sent by SMTP submission.
+func newEML(email *sr.Email) []byte {
+	var (
+		buf    bytes.Buffer
+		header = make(textproto.MIMEHeader)
+	)
+	header.Set("From", (&mail.Address{
+		Name:    email.SenderName,
+		Address: getEMLSender(email) + "@" + EMLDOMAIN,
+	}).String())
+	if email.Identity != "" {
+		header.Set("To", (&mail.Address{
+			Address: email.Identity + "@" + EMLDOMAIN,
+		}).String())
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", email.Head))
+	if t, err := time.Parse(time.RFC850, email.Time); err == nil {
+		header.Set("Date", t.Format(time.RFC1123Z))
+	}
+	header.Set("Message-ID", fmt.Sprintf("<%s@%s>", getEMLId(email), EMLDOMAIN))
+	header.Set("X-HES-Fingerprint", getFingerprint(email.SenderPubl))
+	header.Set("MIME-Version", "1.0")
+	if len(email.Files) == 0 {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeEMLHeader(&buf, header)
+		writeEMLText(&buf, email.Body)
+		return buf.Bytes()
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	writeEMLText(part, email.Body)
+	for _, file := range email.Files {
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("application/octet-stream", map[string]string{"name": file[0]})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": file[0]})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		writeEMLBase64(part, en.Base64Decode(file[1]))
+	}
+	writer.Close()
+	header.Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()}))
+	writeEMLHeader(&buf, header)
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// Mailbox in the mboxrd format with LF,
+// lines 'From ' are quoted by '>'.
+func newMbox(emails []sr.Email) []byte {
+	var buf bytes.Buffer
+	for _, email := range emails {
+		t, err := time.Parse(time.RFC850, email.Time)
+		if err != nil {
+			t = time.Unix(0, 0)
+		}
+		fmt.Fprintf(&buf, "From %s@%s %s\n", getEMLSender(&email), EMLDOMAIN, t.UTC().Format(time.ANSIC))
+		data := bytes.ReplaceAll(newEML(&email), []byte("\r\n"), []byte("\n"))
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				buf.WriteByte('>')
+			}
+			buf.Write(line)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// Contact name if the sender is known,
+// otherwise fingerprint of the public key.
+func getEMLSender(email *sr.Email) string {
+	if email.Contact != "" && !strings.ContainsAny(email.Contact, " <>@\"") {
+		return email.Contact
+	}
+	return strings.ToLower(strings.ReplaceAll(getFingerprint(email.SenderPubl), " ", ""))
+}
+
+// Hash of the email is changed with the password, so Message-ID
+// and UIDL are built from the hash of the package. Emails saved
+// before the package hash have the hash of their content.
+func getEMLId(email *sr.Email) string {
+	if email.Pack != "" {
+		return fmt.Sprintf("%X", en.Base64Decode(email.Pack))
+	}
+	return fmt.Sprintf("%X", cr.NewHasher(bytes.Join(
+		[][]byte{
+			[]byte(email.SenderPubl),
+			[]byte(email.RecvPubl),
+			[]byte(email.Time),
+			[]byte(email.Head),
+			[]byte(email.Body),
+		},
+		[]byte{0},
+	)).Bytes())
+}
+
+func writeEMLHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{
+		"From", "To", "Subject", "Date", "Message-ID",
+		"X-HES-Fingerprint", "MIME-Version",
+		"Content-Type", "Content-Transfer-Encoding",
+	} {
+		if value := header.Get(key); value != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeEMLText(w io.Writer, text string) {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	writer := quotedprintable.NewWriter(w)
+	writer.Write([]byte(text))
+	writer.Close()
+	w.Write([]byte("\r\n"))
+}
+
+func writeEMLBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+)
+
+func TestEMLId(t *testing.T) {
+	newTestDatabase(t)
+	user := hestest.NewUser(t, DATABASE, "username", "password1", pr.NewPrivKey("x25519"))
+	friend := pr.NewPrivKey("x25519")
+	DATABASE.SetContact(user, "friend", friend.PubKey())
+	pack := hestest.NewEmail(friend, user.Priv(), "head", "body")
+	if err := DATABASE.SetEmail(user, user.Priv().PubKey(), pack); err != nil {
+		t.Fatal(err)
+	}
+	email := DATABASE.GetEmailByPack(user, pack)
+	if err := DATABASE.ChangePassword(user, "password2"); err != nil {
+		t.Fatal(err)
+	}
+	changed := DATABASE.GetEmailByPack(user, pack)
+	if changed.Hash == email.Hash {
+		t.Fatal("hash of the email is not changed with the password")
+	}
+	if getEMLId(changed) != getEMLId(email) {
+		t.Error("id of the email is changed with the password")
+	}
+	legacy, other := *email, *email
+	legacy.Pack, other.Pack = "", ""
+	other.Hash = changed.Hash
+	if getEMLId(&legacy) != getEMLId(&other) || getEMLId(&legacy) == getEMLId(email) {
+		t.Error("id of the legacy email is not built from the content")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Events of the user are sent to all open pages
+// of the sessions by the Server-Sent Events.
+const (
+	EVENTBUFFER = 16
+	EVENTPING   = 30 * time.Second
+)
+
+func NewEvents() *Events {
+	return &Events{
+		mpn: make(map[int][]chan Event),
+	}
+}
+
+func (events *Events) Subscribe(id int) chan Event {
+	events.mtx.Lock()
+	defer events.mtx.Unlock()
+	ch := make(chan Event, EVENTBUFFER)
+	events.mpn[id] = append(events.mpn[id], ch)
+	return ch
+}
+
+func (events *Events) Unsubscribe(id int, ch chan Event) {
+	events.mtx.Lock()
+	defer events.mtx.Unlock()
+	list := events.mpn[id]
+	for i := range list {
+		if list[i] == ch {
+			events.mpn[id] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(events.mpn[id]) == 0 {
+		delete(events.mpn, id)
+	}
+}
+
+// Slow pages lose events instead of blocking.
+func (events *Events) Publish(id int, name string, data interface{}) {
+	events.mtx.Lock()
+	defer events.mtx.Unlock()
+	for _, ch := range events.mpn[id] {
+		select {
+		case ch <- Event{Name: name, Data: data}:
+		default:
+		}
+	}
+}
+
+// event: fetch {status: start|node|done, node, nodes}
+// event: email {hash, sender_name, contact, identity}
+// event: send  {node, error}
+func networkEventsPage(w http.ResponseWriter, r *http.Request) {
+	user := SESSIONS.Get(r)
+	if user == nil {
+		http.Error(w, "error: session is closed", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "error: streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ch := EVENTS.Subscribe(user.Id)
+	defer EVENTS.Unsubscribe(user.Id, ch)
+	ticker := time.NewTicker(EVENTPING)
+	defer ticker.Stop()
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			// the stream does not extend the session
+			if !SESSIONS.Alive(r) {
+				return
+			}
+			fmt.Fprint(w, ": ping\n\n")
+		case event := <-ch:
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, data)
+		}
+		flusher.Flush()
+	}
+}
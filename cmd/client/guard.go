@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ACCESSNAME = "access"
+	PATH_CERT  = "s-hes.crt"
+	PATH_KEY   = "s-hes.key"
+)
+
+var (
+	ALLOWREMOTE = flag.Bool("allow-remote", false, "allow to listen not loopback address")
+	ACCESSTOKEN = flag.String("access-token", "", "token required to open the client (?token=...)")
+	ALLOWHOSTS  = flag.String("hosts", "", "additional allowed names in Host header (comma separated)")
+	USETLS      = flag.Bool("tls", false, "serve https with self-signed certificate")
+)
+
+// The client serves private keys, so a not loopback
+// address needs explicit permission and the access token,
+// TLS only protects the traffic.
+func checkListenAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if isLoopback(host) {
+		return nil
+	}
+	if !*ALLOWREMOTE {
+		return fmt.Errorf("address '%s' is not loopback, use -allow-remote", addr)
+	}
+	if *ACCESSTOKEN == "" {
+		return fmt.Errorf("remote access needs -access-token")
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Host header is checked against DNS rebinding,
+// the access token is saved in the cookie after first use.
+func guardHandler(addr string, handler http.Handler) http.Handler {
+	hosts := getAllowedHosts(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !hosts[strings.ToLower(strings.Trim(host, "[]"))] {
+			http.Error(w, "error: host is not allowed", http.StatusForbidden)
+			return
+		}
+		if *ACCESSTOKEN == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if token := r.URL.Query().Get("token"); token != "" {
+			if !equalToken(token) {
+				http.Error(w, "error: access token is not valid", http.StatusUnauthorized)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     ACCESSNAME,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   *USETLS,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, r.URL.Path, http.StatusFound)
+			return
+		}
+		if equalToken(r.Header.Get("X-Access-Token")) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		c, err := r.Cookie(ACCESSNAME)
+		if err != nil || !equalToken(c.Value) {
+			http.Error(w, "error: access token is required", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func equalToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*ACCESSTOKEN)) == 1
+}
+
+func getAllowedHosts(addr string) map[string]bool {
+	hosts := map[string]bool{
+		"localhost": true,
+		"127.0.0.1": true,
+		"::1":       true,
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && host != "" {
+		hosts[strings.ToLower(host)] = true
+	}
+	for _, host := range strings.Split(*ALLOWHOSTS, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts[strings.ToLower(host)] = true
+		}
+	}
+	return hosts
+}
+
+// Certificate is created once and used after restarts,
+// so the exception in the browser stays valid.
+func loadCertificate(addr string) error {
+	_, errc := os.Stat(PATH_CERT)
+	_, errk := os.Stat(PATH_KEY)
+	if errc == nil && errk == nil {
+		return nil
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"HES client"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for host := range getAllowedHosts(addr) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(PATH_CERT, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(PATH_KEY, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+}
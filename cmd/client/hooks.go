@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	sr "github.com/number571/hes/storage"
+)
+
+// Hooks are called for every new email,
+// head and body are passed only with -hook-plaintext.
+const (
+	HOOKTIMEOUT = 10 * time.Second
+)
+
+var (
+	HOOKURL       = flag.String("hook-url", "", "URL for POST of new emails in JSON")
+	HOOKCMD       = flag.String("hook-cmd", "", "command for new emails (JSON in stdin and HES_* variables)")
+	HOOKPLAINTEXT = flag.Bool("hook-plaintext", false, "pass head and body of emails to the hooks")
+)
+
+// Requests go directly, not through socks5,
+// redirects are not followed out of the loopback.
+var (
+	HOOKCLIENT = &http.Client{
+		Timeout: HOOKTIMEOUT,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+type HookEvent struct {
+	Event       string `json:"event"`
+	Account     string `json:"account"`
+	Hash        string `json:"hash"`
+	SenderName  string `json:"sender_name"`
+	Fingerprint string `json:"fingerprint"`
+	Contact     string `json:"contact,omitempty"`
+	Identity    string `json:"identity,omitempty"`
+	Time        string `json:"time"`
+	Files       int    `json:"files"`
+	Head        string `json:"head,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// Emails are decrypted, so they are
+// posted only to the loopback address.
+func checkHookURL(rawurl string) error {
+	if rawurl == "" {
+		return nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("hook url '%s' is not valid", rawurl)
+	}
+	if !isLoopback(u.Hostname()) {
+		return fmt.Errorf("hook url '%s' is not loopback", rawurl)
+	}
+	return nil
+}
+
+// The command is run without a shell,
+// so the program is found at the start.
+func checkHookCmd(command string) error {
+	if command == "" {
+		return nil
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return fmt.Errorf("hook cmd is empty")
+	}
+	_, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("hook cmd '%s' is not found", args[0])
+	}
+	return nil
+}
+
+func runHooks(user *sr.User, email *sr.Email) {
+	if *HOOKURL == "" && *HOOKCMD == "" {
+		return
+	}
+	event := HookEvent{
+		Event:       "email",
+		Account:     user.Name,
+		Hash:        email.Hash,
+		SenderName:  email.SenderName,
+		Fingerprint: getFingerprint(email.SenderPubl),
+		Contact:     email.Contact,
+		Identity:    email.Identity,
+		Time:        email.Time,
+		Files:       len(email.Files),
+	}
+	if *HOOKPLAINTEXT {
+		event.Head = email.Head
+		event.Body = email.Body
+	}
+	if *HOOKURL != "" {
+		err := postHook(*HOOKURL, &event)
+		if err != nil {
+			fmt.Printf("error: hook url: %s\n", err.Error())
+		}
+	}
+	if *HOOKCMD != "" {
+		err := execHook(*HOOKCMD, &event)
+		if err != nil {
+			fmt.Printf("error: hook cmd: %s\n", err.Error())
+		}
+	}
+}
+
+func postHook(url string, event *HookEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := HOOKCLIENT.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// The command is split by spaces without a shell,
+// head and body of the email are only in stdin.
+func execHook(command string, event *HookEvent) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return fmt.Errorf("command is empty")
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HOOKTIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"HES_EVENT="+event.Event,
+		"HES_ACCOUNT="+event.Account,
+		"HES_HASH="+event.Hash,
+		"HES_SENDER_NAME="+event.SenderName,
+		"HES_FINGERPRINT="+event.Fingerprint,
+		"HES_CONTACT="+event.Contact,
+		"HES_IDENTITY="+event.Identity,
+		"HES_TIME="+event.Time,
+		fmt.Sprintf("HES_FILES=%d", event.Files),
+	)
+	return cmd.Run()
+}
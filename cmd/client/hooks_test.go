@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckHookCmd(t *testing.T) {
+	tests := []struct {
+		command string
+		ok      bool
+	}{
+		{"", true},
+		{"true", true},
+		{"true --flag arg", true},
+		{" \t ", false},
+		{"hes-hook-not-found", false},
+	}
+	for _, tt := range tests {
+		if (checkHookCmd(tt.command) == nil) != tt.ok {
+			t.Errorf("command '%s' is not checked", tt.command)
+		}
+	}
+	if execHook(" ", &HookEvent{}) == nil {
+		t.Error("empty command is run")
+	}
+}
+
+func TestPostHookRedirect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect is followed")
+	}))
+	defer target.Close()
+	hook := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer hook.Close()
+	if postHook(hook.URL, &HookEvent{Event: "email"}) == nil {
+		t.Error("redirect is accepted")
+	}
+}
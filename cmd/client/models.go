@@ -1,36 +1,38 @@
 package main
 
 import (
-	"database/sql"
 	"sync"
 
-	_ "github.com/mattn/go-sqlite3"
-	cr "github.com/number571/go-peer/crypto"
+	sr "github.com/number571/hes/storage"
 )
 
-type DB struct {
-	ptr *sql.DB
-	mtx sync.Mutex
+type Sessions struct {
+	mpn  map[string]*sessionData
+	refs map[*sr.User]int
+	mtx  sync.Mutex
 }
 
-type Sessions struct {
-	mpn map[string]*sessionData
+type Events struct {
+	mpn map[int][]chan Event
 	mtx sync.Mutex
 }
 
-type User struct {
-	Id   int
+type Event struct {
 	Name string
-	Pasw []byte
-	Priv cr.PrivKey
+	Data interface{}
+}
+
+type FetchResult struct {
+	Node   string `json:"node"`
+	Emails int    `json:"emails"`
+	Error  string `json:"error,omitempty"`
 }
 
-type Email struct {
-	Id         int
-	SenderName string
-	SenderPubl string
-	Head       string
-	Body       string
-	Hash       string
-	Time       string
+type Session struct {
+	Id      string
+	Addr    string
+	Agent   string
+	Created string
+	Active  string
+	Current bool
 }
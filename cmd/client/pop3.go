@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	sr "github.com/number571/hes/storage"
+)
+
+// Read access of mail clients to the decrypted mailbox,
+// messages are taken at signin. Deleted messages are only
+// hidden in the session, without -pop3-delete they stay
+// in the client after QUIT.
+const (
+	POP3TIMEOUT = 10 * time.Minute
+)
+
+var (
+	POP3ADDR   = flag.String("pop3", "", "listen address of POP3 access to the mailbox (loopback only)")
+	POP3DELETE = flag.Bool("pop3-delete", false, "delete emails from the client by DELE of POP3")
+)
+
+type pop3Session struct {
+	text     *textproto.Conn
+	name     string
+	user     *sr.User
+	messages []pop3Message
+}
+
+type pop3Message struct {
+	hash    string
+	uid     string
+	data    []byte
+	deleted bool
+}
+
+func servePOP3(conn net.Conn) {
+	sess := &pop3Session{text: textproto.NewConn(conn)}
+	defer func() {
+		signoutMail(sess.user)
+		sess.text.Close()
+	}()
+	sess.ok("HES POP3 ready")
+	for {
+		conn.SetDeadline(time.Now().Add(POP3TIMEOUT))
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			return
+		}
+		params := strings.Fields(line)
+		if len(params) == 0 {
+			sess.err("command is null")
+			continue
+		}
+		cmd := strings.ToUpper(params[0])
+		args := params[1:]
+		if cmd == "QUIT" {
+			sess.quit()
+			return
+		}
+		if sess.user == nil {
+			sess.authorization(cmd, args, line)
+			continue
+		}
+		sess.transaction(cmd, args)
+	}
+}
+
+func (sess *pop3Session) authorization(cmd string, args []string, line string) {
+	switch cmd {
+	case "CAPA":
+		sess.multi("capability list", []string{"USER", "TOP", "UIDL"})
+	case "USER":
+		if len(args) != 1 {
+			sess.err("syntax: USER name")
+			return
+		}
+		sess.name = args[0]
+		sess.ok("send password")
+	case "PASS":
+		if sess.name == "" {
+			sess.err("need USER command")
+			return
+		}
+		// password can contain spaces
+		pasw := strings.TrimPrefix(line[4:], " ")
+		sess.user = signinMail(sess.name, pasw)
+		if sess.user == nil {
+			sess.name = ""
+			sess.err("authentication failed")
+			return
+		}
+		sess.load()
+		sess.ok(fmt.Sprintf("%d messages", len(sess.messages)))
+	default:
+		sess.err("authentication required")
+	}
+}
+
+func (sess *pop3Session) transaction(cmd string, args []string) {
+	switch cmd {
+	case "CAPA":
+		sess.multi("capability list", []string{"USER", "TOP", "UIDL"})
+	case "STAT":
+		count, size := 0, 0
+		for _, msg := range sess.messages {
+			if !msg.deleted {
+				count++
+				size += len(msg.data)
+			}
+		}
+		sess.ok(fmt.Sprintf("%d %d", count, size))
+	case "LIST", "UIDL":
+		if len(args) == 1 {
+			msg, num := sess.message(args[0])
+			if msg == nil {
+				return
+			}
+			sess.ok(sess.listLine(cmd, num, msg))
+			return
+		}
+		var lines []string
+		for i := range sess.messages {
+			if !sess.messages[i].deleted {
+				lines = append(lines, sess.listLine(cmd, i+1, &sess.messages[i]))
+			}
+		}
+		sess.multi("list follows", lines)
+	case "RETR":
+		if len(args) != 1 {
+			sess.err("syntax: RETR msg")
+			return
+		}
+		msg, _ := sess.message(args[0])
+		if msg == nil {
+			return
+		}
+		sess.data(fmt.Sprintf("%d octets", len(msg.data)), msg.data)
+	case "TOP":
+		if len(args) != 2 {
+			sess.err("syntax: TOP msg n")
+			return
+		}
+		msg, _ := sess.message(args[0])
+		if msg == nil {
+			return
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			sess.err("number of lines is not valid")
+			return
+		}
+		sess.data("top of message follows", getTopLines(msg.data, n))
+	case "DELE":
+		if len(args) != 1 {
+			sess.err("syntax: DELE msg")
+			return
+		}
+		msg, _ := sess.message(args[0])
+		if msg == nil {
+			return
+		}
+		msg.deleted = true
+		sess.ok("message deleted")
+	case "RSET":
+		for i := range sess.messages {
+			sess.messages[i].deleted = false
+		}
+		sess.ok("maildrop reset")
+	case "NOOP":
+		sess.ok("")
+	default:
+		sess.err("command not implemented")
+	}
+}
+
+func (sess *pop3Session) load() {
+	for _, email := range DATABASE.GetMailbox(sess.user) {
+		sess.messages = append(sess.messages, pop3Message{
+			hash: email.Hash,
+			uid:  getEMLId(&email),
+			data: newEML(&email),
+		})
+	}
+}
+
+func (sess *pop3Session) quit() {
+	for _, msg := range sess.messages {
+		if msg.deleted && *POP3DELETE {
+			DATABASE.DelEmail(sess.user, msg.hash)
+		}
+	}
+	sess.ok("bye")
+}
+
+func (sess *pop3Session) message(arg string) (*pop3Message, int) {
+	num, err := strconv.Atoi(arg)
+	if err != nil || num < 1 || num > len(sess.messages) {
+		sess.err("no such message")
+		return nil, 0
+	}
+	msg := &sess.messages[num-1]
+	if msg.deleted {
+		sess.err("message already deleted")
+		return nil, 0
+	}
+	return msg, num
+}
+
+func (sess *pop3Session) listLine(cmd string, num int, msg *pop3Message) string {
+	if cmd == "UIDL" {
+		return fmt.Sprintf("%d %s", num, msg.uid)
+	}
+	return fmt.Sprintf("%d %d", num, len(msg.data))
+}
+
+func (sess *pop3Session) ok(text string) {
+	sess.text.PrintfLine("+OK %s", text)
+}
+
+func (sess *pop3Session) err(text string) {
+	sess.text.PrintfLine("-ERR %s", text)
+}
+
+func (sess *pop3Session) multi(text string, lines []string) {
+	sess.ok(text)
+	writer := sess.text.DotWriter()
+	for _, line := range lines {
+		fmt.Fprintf(writer, "%s\n", line)
+	}
+	writer.Close()
+}
+
+func (sess *pop3Session) data(text string, data []byte) {
+	sess.ok(text)
+	writer := sess.text.DotWriter()
+	writer.Write(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")))
+	writer.Close()
+}
+
+// Header and the first n lines of the body.
+func getTopLines(data []byte, n int) []byte {
+	parts := bytes.SplitN(data, []byte("\r\n\r\n"), 2)
+	if len(parts) != 2 {
+		return data
+	}
+	lines := bytes.SplitN(parts[1], []byte("\r\n"), n+1)
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	return bytes.Join([][]byte{
+		parts[0],
+		bytes.Join(lines, []byte("\r\n")),
+	}, []byte("\r\n\r\n"))
+}
@@ -1,82 +1,354 @@
 package main
 
 import (
+	"crypto/subtle"
+	"flag"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	cr "github.com/number571/go-peer/crypto"
 	gp "github.com/number571/go-peer/settings"
 	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
+)
+
+const (
+	COOKIENAME = "storage"
+)
+
+var (
+	SESSIDLE   = flag.Duration("session-idle", 1*time.Hour, "close session after inactivity")
+	SESSLIFE   = flag.Duration("session-life", 12*time.Hour, "close session after signin anyway")
+	SESSSECURE = flag.Bool("session-secure", false, "send session cookie only over https")
 )
 
 type sessionData struct {
-	user *User
-	ts   time.Time
+	user    *sr.User
+	csrf    string
+	addr    string
+	agent   string
+	created time.Time
+	ts      time.Time
 }
 
 func NewSessions() *Sessions {
 	return &Sessions{
-		mpn: make(map[string]*sessionData),
+		mpn:  make(map[string]*sessionData),
+		refs: make(map[*sr.User]int),
 	}
 }
 
-func (sessions *Sessions) Set(w http.ResponseWriter, user *User) {
+// The user must be returned by Share,
+// so all sessions of the account have one object.
+func (sessions *Sessions) Set(w http.ResponseWriter, r *http.Request, user *sr.User) {
+	createCookie(w, sessions.NewToken(r, user))
+}
+
+// Token is the key of the session without the cookie,
+// it is used by the API in the Authorization header.
+func (sessions *Sessions) NewToken(r *http.Request, user *sr.User) string {
 	sessions.mtx.Lock()
 	defer sessions.mtx.Unlock()
-	for k, v := range sessions.mpn {
-		if v.user.Name == user.Name {
-			delete(sessions.mpn, k)
-			break
-		}
-	}
 	key := cr.RandString(st.SETTINGS.Get(gp.SizeSkey))
 	sessions.mpn[key] = &sessionData{
-		user: user,
-		ts:   time.Now(),
+		user:    user,
+		csrf:    cr.RandString(st.SETTINGS.Get(gp.SizeSkey)),
+		addr:    r.RemoteAddr,
+		agent:   r.UserAgent(),
+		created: time.Now(),
+		ts:      time.Now(),
 	}
-	createCookie(w, key)
+	return key
+}
+
+func (sessions *Sessions) Get(r *http.Request) *sr.User {
+	return sessions.GetByToken(readCookie(r))
 }
 
-func (sessions *Sessions) Get(r *http.Request) *User {
+func (sessions *Sessions) GetByToken(key string) *sr.User {
 	sessions.mtx.Lock()
 	defer sessions.mtx.Unlock()
-	key := readCookie(r)
-	if _, ok := sessions.mpn[key]; !ok {
+	sess, ok := sessions.mpn[key]
+	if !ok {
+		return nil
+	}
+	if sessionExpired(sess, time.Now()) {
+		sessions.delete(key)
 		return nil
 	}
-	sessions.mpn[key].ts = time.Now()
-	return sessions.mpn[key].user
+	sess.ts = time.Now()
+	return sess.user
+}
+
+// Session is checked without update of the activity.
+func (sessions *Sessions) Alive(r *http.Request) bool {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sess, ok := sessions.mpn[readCookie(r)]
+	return ok && !sessionExpired(sess, time.Now())
+}
+
+// Token is put into all forms of the session.
+func (sessions *Sessions) Token(r *http.Request) string {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sess, ok := sessions.mpn[readCookie(r)]
+	if !ok {
+		return ""
+	}
+	return sess.csrf
+}
+
+// Requests without a session have no token, but signin and signup
+// must not be sent by other site (login CSRF), so their origin is checked.
+func (sessions *Sessions) CheckToken(r *http.Request, token string) bool {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sess, ok := sessions.mpn[readCookie(r)]
+	if !ok {
+		return isSameOrigin(r)
+	}
+	return subtle.ConstantTimeCompare([]byte(sess.csrf), []byte(token)) == 1
+}
+
+// Browsers send Origin (or at least Referer) with forms,
+// requests without both are not sent by browser.
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
 }
 
 func (sessions *Sessions) Del(w http.ResponseWriter, r *http.Request) {
 	sessions.mtx.Lock()
 	defer sessions.mtx.Unlock()
-	delete(sessions.mpn, readCookie(r))
+	sessions.delete(readCookie(r))
 	deleteCookie(w)
 }
 
-func (sessions *Sessions) DelByTime(t time.Duration) {
+func (sessions *Sessions) DelByToken(key string) {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sessions.delete(key)
+}
+
+func (sessions *Sessions) DelByTime() {
 	sessions.mtx.Lock()
 	defer sessions.mtx.Unlock()
 	currTime := time.Now()
 	for k, v := range sessions.mpn {
-		if v.ts.Add(t).Before(currTime) {
-			delete(sessions.mpn, k)
+		if sessionExpired(v, currTime) {
+			sessions.delete(k)
+		}
+	}
+}
+
+// Sessions of the user except the current one are closed.
+func (sessions *Sessions) DelOthers(r *http.Request, user *sr.User) {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	key := readCookie(r)
+	for k, v := range sessions.mpn {
+		if k != key && v.user.Id == user.Id {
+			sessions.delete(k)
+		}
+	}
+}
+
+// Id is hash of the cookie, the cookie itself is not shown.
+func (sessions *Sessions) Revoke(user *sr.User, id string) bool {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	for k, v := range sessions.mpn {
+		if v.user.Id == user.Id && getSessionId(k) == id {
+			sessions.delete(k)
+			return true
+		}
+	}
+	return false
+}
+
+// The current session is the first, others are sorted by creation.
+func (sessions *Sessions) List(r *http.Request, user *sr.User) []Session {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	var keys []string
+	current := readCookie(r)
+	for k, v := range sessions.mpn {
+		if v.user.Id == user.Id {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == current || keys[j] == current {
+			return keys[i] == current
+		}
+		return sessions.mpn[keys[i]].created.Before(sessions.mpn[keys[j]].created)
+	})
+	list := make([]Session, 0, len(keys))
+	for _, k := range keys {
+		v := sessions.mpn[k]
+		list = append(list, Session{
+			Id:      getSessionId(k),
+			Addr:    v.addr,
+			Agent:   v.agent,
+			Created: v.created.Format(time.RFC850),
+			Active:  v.ts.Format(time.RFC850),
+			Current: k == current,
+		})
+	}
+	return list
+}
+
+// The user of the account is shared by sessions, requests and tasks,
+// so keys changed by one of them are seen by all. The new user is
+// wiped if the account is in use. The user is held until Release.
+func (sessions *Sessions) Share(user *sr.User) *sr.User {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	if shared := sessions.find(user.Id); shared != nil && shared != user {
+		DATABASE.WipeUser(user)
+		user = shared
+	}
+	sessions.refs[user]++
+	return user
+}
+
+// The user is held by requests and background tasks,
+// it is not held if all sessions of the user are closed.
+func (sessions *Sessions) Hold(user *sr.User) bool {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	if !sessions.inUse(user) {
+		return false
+	}
+	sessions.refs[user]++
+	return true
+}
+
+// The session is held without update of the activity.
+func (sessions *Sessions) HoldByToken(key string) *sr.User {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sess, ok := sessions.mpn[key]
+	if !ok || sessionExpired(sess, time.Now()) {
+		return nil
+	}
+	sessions.refs[sess.user]++
+	return sess.user
+}
+
+func (sessions *Sessions) Release(user *sr.User) {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sessions.refs[user]--
+	if sessions.refs[user] > 0 {
+		return
+	}
+	delete(sessions.refs, user)
+	if !sessions.inUse(user) {
+		DATABASE.WipeUser(user)
+	}
+}
+
+// The task works with the user after the end of the request.
+func (sessions *Sessions) Go(user *sr.User, task func()) {
+	if !sessions.Hold(user) {
+		return
+	}
+	go func() {
+		defer sessions.Release(user)
+		task()
+	}()
+}
+
+// Key material is overwritten when the last session
+// of the user is closed and nothing holds the user.
+func (sessions *Sessions) delete(key string) {
+	sess, ok := sessions.mpn[key]
+	if !ok {
+		return
+	}
+	delete(sessions.mpn, key)
+	if !sessions.inUse(sess.user) {
+		DATABASE.WipeUser(sess.user)
+	}
+}
+
+func (sessions *Sessions) find(id int) *sr.User {
+	for _, v := range sessions.mpn {
+		if v.user.Id == id {
+			return v.user
 		}
 	}
+	for user := range sessions.refs {
+		if user.Id == id {
+			return user
+		}
+	}
+	return nil
+}
+
+func (sessions *Sessions) inUse(user *sr.User) bool {
+	if sessions.refs[user] > 0 {
+		return true
+	}
+	for _, v := range sessions.mpn {
+		if v.user == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Users of the cookie and of the API token
+// are held until the end of the request.
+func holdSessions(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{readCookie(r), readBearer(r)} {
+			if user := SESSIONS.HoldByToken(key); user != nil {
+				defer SESSIONS.Release(user)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func sessionExpired(sess *sessionData, t time.Time) bool {
+	return sess.ts.Add(*SESSIDLE).Before(t) || sess.created.Add(*SESSLIFE).Before(t)
+}
+
+func getSessionId(key string) string {
+	return cr.NewHasher([]byte(key)).String()
 }
 
 func createCookie(w http.ResponseWriter, data string) {
 	c := http.Cookie{
-		Name:   "storage",
-		Value:  data,
-		MaxAge: 3600,
+		Name:     COOKIENAME,
+		Value:    data,
+		Path:     "/",
+		MaxAge:   int(SESSLIFE.Seconds()),
+		HttpOnly: true,
+		Secure:   *SESSSECURE,
+		SameSite: http.SameSiteStrictMode,
 	}
 	http.SetCookie(w, &c)
 }
 
 func readCookie(r *http.Request) string {
-	c, err := r.Cookie("storage")
+	c, err := r.Cookie(COOKIENAME)
 	value := ""
 	if err == nil {
 		value = c.Value
@@ -86,8 +358,12 @@ func readCookie(r *http.Request) string {
 
 func deleteCookie(w http.ResponseWriter) {
 	c := http.Cookie{
-		Name:   "storage",
-		MaxAge: -1,
+		Name:     COOKIENAME,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   *SESSSECURE,
+		SameSite: http.SameSiteStrictMode,
 	}
 	http.SetCookie(w, &c)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+	sr "github.com/number571/hes/storage"
+)
+
+func TestSessionsList(t *testing.T) {
+	sessions := NewSessions()
+	user := &sr.User{Id: 1}
+	// names of weekdays are not sorted as the days
+	days := []time.Time{
+		time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), // Tuesday
+		time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC), // Wednesday
+		time.Date(2026, 10, 22, 0, 0, 0, 0, time.UTC), // Thursday
+		time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), // Monday, current
+	}
+	var key string
+	for _, day := range days {
+		key = sessions.NewToken(httptest.NewRequest("GET", "/", nil), user)
+		sessions.mpn[key].created = day
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", COOKIENAME+"="+key)
+	list := sessions.List(r, user)
+	if len(list) != len(days) || !list[0].Current {
+		t.Fatal("current session is not the first")
+	}
+	for i, day := range days[:3] {
+		if list[i+1].Created != day.Format(time.RFC850) {
+			t.Errorf("%d: session of %s", i+1, list[i+1].Created)
+		}
+	}
+}
+
+func TestSessionsShare(t *testing.T) {
+	newTestDatabase(t)
+	hestest.NewUser(t, DATABASE, "username", "password", pr.NewPrivKey("x25519"))
+	sessions := NewSessions()
+	user := sessions.Share(DATABASE.GetUser("username", "password"))
+	key := sessions.NewToken(httptest.NewRequest("GET", "/", nil), user)
+	sessions.Release(user)
+
+	other := DATABASE.GetUser("username", "password")
+	if sessions.Share(other) != user {
+		t.Fatal("user of the account is not shared")
+	}
+	if !isTestWiped(other) {
+		t.Error("new user of the account is not wiped")
+	}
+	sessions.DelByToken(key)
+	if isTestWiped(user) {
+		t.Fatal("held user is wiped")
+	}
+	sessions.Release(user)
+	if !isTestWiped(user) {
+		t.Error("user is not wiped after release")
+	}
+}
+
+func TestSessionsCheckToken(t *testing.T) {
+	sessions := NewSessions()
+	tests := []struct {
+		origin  string
+		referer string
+		ok      bool
+	}{
+		{"", "", true},
+		{"http://localhost:8080", "", true},
+		{"", "http://localhost:8080/signin", true},
+		{"http://evil.example", "", false},
+		{"", "http://evil.example/form", false},
+		{"null", "", false},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", "http://localhost:8080/signin", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			r.Header.Set("Referer", test.referer)
+		}
+		if sessions.CheckToken(r, "") != test.ok {
+			t.Errorf("%d: origin '%s', referer '%s'", i, test.origin, test.referer)
+		}
+	}
+}
+
+func isTestWiped(user *sr.User) bool {
+	return bytes.Equal(user.Priv().Bytes()[:32], make([]byte, 32))
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+	gp "github.com/number571/go-peer/settings"
+
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
+)
+
+// Submission of emails by standard mail tools.
+// Receiver 'name@any' is the contact with this name,
+// sender 'name@any' selects the identity of the account.
+const (
+	SMTPNAME    = "hes"
+	SMTPTIMEOUT = 5 * time.Minute
+	SMTPRCPTS   = 16
+)
+
+var (
+	SMTPADDR = flag.String("smtp", "", "listen address of SMTP submission (loopback only)")
+)
+
+type smtpSession struct {
+	text   *textproto.Conn
+	user   *sr.User
+	sender *sr.Identity
+	recvs  []smtpRecipient
+}
+
+type smtpRecipient struct {
+	name string
+	pub  cr.PubKey
+}
+
+// Credentials are not encrypted,
+// so mail listeners are only on the loopback.
+func listenMail(addr string, serve func(net.Conn)) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopback(host) {
+		return fmt.Errorf("address '%s' is not loopback", addr)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				continue
+			}
+			go serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Password is the password of the account
+// or the token of the API if two-factor is enabled.
+// The user is shared with sessions of the account,
+// it is held until the signout.
+func signinMail(name, pasw string) *sr.User {
+	if user := SESSIONS.HoldByToken(pasw); user != nil {
+		if user.Name == name {
+			return user
+		}
+		SESSIONS.Release(user)
+	}
+	user := DATABASE.GetUser(name, pasw)
+	if user == nil {
+		return nil
+	}
+	if DATABASE.StateTOTP(user) {
+		DATABASE.WipeUser(user)
+		return nil
+	}
+	return SESSIONS.Share(user)
+}
+
+func signoutMail(user *sr.User) {
+	if user == nil {
+		return
+	}
+	SESSIONS.Release(user)
+}
+
+func serveSMTP(conn net.Conn) {
+	sess := &smtpSession{text: textproto.NewConn(conn)}
+	defer func() {
+		sess.signout()
+		sess.text.Close()
+	}()
+	sess.reply(220, SMTPNAME+" ESMTP ready")
+	for {
+		conn.SetDeadline(time.Now().Add(SMTPTIMEOUT))
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(cmd) {
+		case "HELO":
+			sess.reply(250, SMTPNAME)
+		case "EHLO":
+			sess.reply(250, SMTPNAME,
+				fmt.Sprintf("SIZE %d", st.SETTINGS.Get(gp.SizePack)),
+				"8BITMIME",
+				"AUTH PLAIN LOGIN",
+			)
+		case "AUTH":
+			sess.auth(arg)
+		case "MAIL":
+			sess.mailFrom(arg)
+		case "RCPT":
+			sess.rcptTo(arg)
+		case "DATA":
+			sess.data()
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "OK")
+		case "NOOP":
+			sess.reply(250, "OK")
+		case "QUIT":
+			sess.reply(221, "bye")
+			return
+		default:
+			sess.reply(502, "command not implemented")
+		}
+	}
+}
+
+func (sess *smtpSession) auth(arg string) {
+	if sess.user != nil {
+		sess.reply(503, "already authenticated")
+		return
+	}
+	var name, pasw string
+	params := strings.Fields(arg)
+	switch {
+	case len(params) >= 1 && strings.EqualFold(params[0], "PLAIN"):
+		resp := ""
+		if len(params) == 2 {
+			resp = params[1]
+		} else {
+			resp = sess.challenge("")
+		}
+		data, err := base64.StdEncoding.DecodeString(resp)
+		fields := strings.Split(string(data), "\x00")
+		if err != nil || len(fields) != 3 {
+			sess.reply(501, "invalid credentials format")
+			return
+		}
+		name, pasw = fields[1], fields[2]
+	case len(params) >= 1 && strings.EqualFold(params[0], "LOGIN"):
+		resp := ""
+		if len(params) == 2 {
+			resp = params[1]
+		} else {
+			resp = sess.challenge("Username:")
+		}
+		bname, err1 := base64.StdEncoding.DecodeString(resp)
+		bpasw, err2 := base64.StdEncoding.DecodeString(sess.challenge("Password:"))
+		if err1 != nil || err2 != nil {
+			sess.reply(501, "invalid credentials format")
+			return
+		}
+		name, pasw = string(bname), string(bpasw)
+	default:
+		sess.reply(504, "authentication mechanism not supported")
+		return
+	}
+	sess.user = signinMail(name, pasw)
+	if sess.user == nil {
+		sess.reply(535, "authentication failed")
+		return
+	}
+	sess.reply(235, "authentication successful")
+}
+
+func (sess *smtpSession) mailFrom(arg string) {
+	if sess.user == nil {
+		sess.reply(530, "authentication required")
+		return
+	}
+	addr, ok := parsePath(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "syntax: MAIL FROM:<address>")
+		return
+	}
+	sess.reset()
+	sess.sender = getIdentityByName(sess.user, localPart(addr))
+	if sess.sender == nil {
+		sess.reply(550, "identity not found")
+		return
+	}
+	sess.reply(250, "OK")
+}
+
+func (sess *smtpSession) rcptTo(arg string) {
+	if sess.sender == nil {
+		sess.reply(503, "need MAIL command")
+		return
+	}
+	addr, ok := parsePath(arg, "TO:")
+	if !ok {
+		sess.reply(501, "syntax: RCPT TO:<address>")
+		return
+	}
+	if len(sess.recvs) == SMTPRCPTS {
+		sess.reply(452, "too many recipients")
+		return
+	}
+	name := localPart(addr)
+	recv := getContactByName(sess.user, name)
+	if recv == nil {
+		sess.reply(550, "contact not found")
+		return
+	}
+	sess.recvs = append(sess.recvs, smtpRecipient{name: name, pub: recv})
+	sess.reply(250, "OK")
+}
+
+func (sess *smtpSession) data() {
+	if len(sess.recvs) == 0 {
+		sess.reply(503, "need RCPT command")
+		return
+	}
+	sess.reply(354, "end data with <CR><LF>.<CR><LF>")
+	limit := int64(st.SETTINGS.Get(gp.SizePack))
+	reader := sess.text.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	io.Copy(ioutil.Discard, reader)
+	defer sess.reset()
+	if err != nil {
+		sess.reply(451, "read data")
+		return
+	}
+	if int64(len(data)) > limit {
+		sess.reply(552, "max size")
+		return
+	}
+	head, body, err := parseMIME(data)
+	if err != nil {
+		sess.reply(554, err.Error())
+		return
+	}
+	// the email is sent only if it is valid for all recipients
+	packs := make([]lc.Message, len(sess.recvs))
+	for i, recv := range sess.recvs {
+		pack, err := pr.NewPackage(sess.sender.Priv, recv.pub, pr.NewEmail(sess.sender.Name, head, body))
+		if err != nil {
+			sess.reply(554, fmt.Sprintf("%s: %s, email not sent", recv.name, err.Error()))
+			return
+		}
+		packs[i] = pack
+	}
+	for i, recv := range sess.recvs {
+		sendPackage(sess.user, recv.pub, packs[i])
+	}
+	sess.reply(250, "OK: email send")
+}
+
+func (sess *smtpSession) challenge(prompt string) string {
+	sess.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := sess.text.ReadLine()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(line)
+}
+
+func (sess *smtpSession) reset() {
+	sess.sender = nil
+	sess.recvs = nil
+}
+
+func (sess *smtpSession) signout() {
+	signoutMail(sess.user)
+	sess.user = nil
+}
+
+func (sess *smtpSession) reply(code int, lines ...string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		sess.text.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+// head = subject || FS || filename...
+// body = text || FS || base64(file)...
+func parseMIME(data []byte) (string, string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("parse message")
+	}
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	var (
+		text  string
+		files [][2]string
+	)
+	err = parsePart(textproto.MIMEHeader(msg.Header), msg.Body, &text, &files)
+	if err != nil {
+		return "", "", err
+	}
+	head := strings.TrimSpace(subject)
+	body := strings.TrimSpace(text)
+	if head == "" || body == "" {
+		return "", "", fmt.Errorf("head or body is null")
+	}
+	for _, file := range files {
+		head += pr.FSEPARAT + file[0]
+		body += pr.FSEPARAT + file[1]
+	}
+	return head, body, nil
+}
+
+// The first text part is the body,
+// parts with a file name are attachments.
+func parsePart(header textproto.MIMEHeader, reader io.Reader, text *string, files *[][2]string) error {
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediatype, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediatype, "multipart/") {
+		mreader := multipart.NewReader(reader, params["boundary"])
+		for {
+			part, err := mreader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("parse multipart")
+			}
+			err = parsePart(part.Header, part, text, files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	data, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), reader))
+	if err != nil {
+		return fmt.Errorf("decode part")
+	}
+	if name := getFileName(header, params); name != "" {
+		*files = append(*files, [2]string{name, en.Base64Encode(data)})
+		return nil
+	}
+	if *text == "" && strings.HasPrefix(mediatype, "text/") {
+		*text = string(data)
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, reader io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &lineSkipper{reader: reader})
+	case "quoted-printable":
+		return quotedprintable.NewReader(reader)
+	}
+	return reader
+}
+
+func getFileName(header textproto.MIMEHeader, params map[string]string) string {
+	decoder := new(mime.WordDecoder)
+	name := params["name"]
+	_, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	if dname, err := decoder.DecodeHeader(name); err == nil {
+		name = dname
+	}
+	return strings.TrimSpace(name)
+}
+
+// Base64 of MIME is split into lines.
+type lineSkipper struct {
+	reader io.Reader
+}
+
+func (skipper *lineSkipper) Read(p []byte) (int, error) {
+	n, err := skipper.reader.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		if p[i] != '\r' && p[i] != '\n' && p[i] != ' ' && p[i] != '\t' {
+			p[j] = p[i]
+			j++
+		}
+	}
+	return j, err
+}
+
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if path == "" {
+		return "", false
+	}
+	if i := strings.IndexByte(path, '>'); strings.HasPrefix(path, "<") && i != -1 {
+		return path[1:i], true
+	}
+	return strings.Fields(path)[0], true
+}
+
+func localPart(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i != -1 {
+		return addr[:i]
+	}
+	return addr
+}
+
+// The main key is under the account name.
+func getIdentityByName(user *sr.User, name string) *sr.Identity {
+	for _, identity := range getIdentities(user) {
+		if strings.EqualFold(identity.Name, name) {
+			return &identity
+		}
+	}
+	return nil
+}
+
+func getContactByName(user *sr.User, name string) cr.PubKey {
+	for _, contact := range DATABASE.GetContacts(user) {
+		if strings.EqualFold(contact.Name, name) {
+			return pr.LoadPubKeyByString(contact.Publ)
+		}
+	}
+	return nil
+}
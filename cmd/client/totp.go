@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"net/url"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	en "github.com/number571/go-peer/encoding"
+
+	sr "github.com/number571/hes/storage"
+)
+
+const (
+	TOTPISSUER = "HES"
+)
+
+func getTOTPURI(name, secret string) string {
+	return fmt.Sprintf(
+		"otpauth://totp/%s:%s?secret=%s&issuer=%s&digits=%d&period=%d",
+		TOTPISSUER,
+		url.PathEscape(name),
+		secret,
+		TOTPISSUER,
+		sr.TOTPDIGITS,
+		sr.TOTPPERIOD,
+	)
+}
+
+// Image for the enrollment in base64(png).
+func getTOTPImage(name, secret string) string {
+	if secret == "" {
+		return ""
+	}
+	qrCode, err := qr.Encode(getTOTPURI(name, secret), qr.M, qr.Auto)
+	if err != nil {
+		return ""
+	}
+	qrCode, err = barcode.Scale(qrCode, 256, 256)
+	if err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, qrCode)
+	return en.Base64Encode(buf.Bytes())
+}
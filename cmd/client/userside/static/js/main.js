@@ -23,7 +23,77 @@ function close_block(id) {
 	e.style.display = 'none';
 }
 
+function check_verified(id, message) {
+	var e = document.getElementById(id);
+	var option = e.options[e.selectedIndex];
+	if(option && option.getAttribute('data-verified') == 'false')
+		open_block(message);
+	else
+		close_block(message);
+}
+
 function clear_value(id) {
     var e = document.getElementById(id);
     e.value = "";
 }
+
+// Live updates of the client by the Server-Sent Events.
+document.addEventListener('DOMContentLoaded', open_events);
+
+function open_events() {
+    if(!window.EventSource || !document.getElementById('events'))
+        return;
+    var source = new EventSource('/network/events');
+    source.addEventListener('fetch', function(e) {
+        var data = JSON.parse(e.data);
+        if(data.status == 'start')
+            show_event('info', 'loading emails from ' + data.nodes + ' nodes');
+        else if(data.status == 'done')
+            update_emails();
+    });
+    source.addEventListener('email', function(e) {
+        var data = JSON.parse(e.data);
+        show_event('success', 'new email from ' + (data.contact || data.sender_name));
+        update_emails();
+    });
+    source.addEventListener('send', function(e) {
+        var data = JSON.parse(e.data);
+        if(data.error)
+            show_event('danger', data.node + ': ' + data.error);
+        else
+            show_event('success', 'email delivered to ' + data.node);
+    });
+}
+
+function show_event(kind, text) {
+    var e = document.createElement('div');
+    e.className = 'alert alert-' + kind;
+    e.textContent = text;
+    document.getElementById('events').appendChild(e);
+    setTimeout(function() { e.remove(); }, 10000);
+}
+
+// The list is taken from the same page loaded again.
+function update_emails() {
+    var list = document.getElementById('emails');
+    if(!list)
+        return;
+    fetch(location.href, {credentials: 'same-origin'})
+        .then(function(resp) { return resp.text(); })
+        .then(function(html) {
+            var doc = new DOMParser().parseFromString(html, 'text/html');
+            var loaded = doc.getElementById('emails');
+            if(loaded)
+                list.innerHTML = loaded.innerHTML;
+        });
+}
+
+function update_async(form) {
+    if(!window.fetch || !window.EventSource)
+        return true;
+    var data = new FormData(form);
+    data.append('update', 'Update');
+    data.append('async', 'true');
+    fetch(form.action, {method: 'POST', body: data, credentials: 'same-origin'});
+    return false;
+}
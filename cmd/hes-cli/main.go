@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
+)
+
+// The command works with the database of the client,
+// so the web interface and the command see the same data.
+const (
+	MAXEPAGE = 10 // list emails in one page
+	MAXCOUNT = 5  // load emails from one node
+	PASWENV  = "HES_PASSWORD"
+)
+
+var (
+	DBPATH    = flag.String("db", "s-hes.db", "path to the database of the client")
+	USERNAME  = flag.String("user", "", "name of the account")
+	TOTPCODE  = flag.String("code", "", "two-factor code or recovery code")
+	KDFPARAMS = flag.String("kdf", sr.KDFDEFAULT, "password hardening of the account (argon2id:time:memory(KiB):threads)")
+)
+
+var (
+	DATABASE *sr.DB
+	STDIN    = bufio.NewReader(os.Stdin)
+)
+
+func main() {
+	flag.Usage = usage
+	st.HesDefaultInit("")
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*DBPATH); err != nil {
+		fail(fmt.Errorf("database '%s' not found", *DBPATH))
+	}
+	DATABASE = sr.NewDB(*DBPATH)
+	if DATABASE == nil {
+		fail(fmt.Errorf("open database"))
+	}
+	err := DATABASE.SetKDF(*KDFPARAMS)
+	if err != nil {
+		fail(err)
+	}
+	user, err := signin()
+	if err != nil {
+		fail(err)
+	}
+	switch args[0] {
+	case "send":
+		err = sendCommand(user, args[1:])
+	case "fetch":
+		err = fetchCommand(user, args[1:])
+	case "list":
+		err = listCommand(user, args[1:])
+	case "read":
+		err = readCommand(user, args[1:])
+	case "contacts":
+		err = contactsCommand(user, args[1:])
+	case "connects":
+		err = connectsCommand(user, args[1:])
+	case "key":
+		err = keyCommand(user, args[1:])
+	default:
+		err = fmt.Errorf("unknown command '%s'", args[0])
+	}
+	DATABASE.WipeUser(user)
+	if err != nil {
+		fail(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [options] command [arguments]
+
+Commands:
+  send [-from identity] receiver head [body|-] [file...]
+  fetch
+  list [page]
+  read [-save dir] hash
+  contacts list | add name public_key | del name|public_key
+  connects list | add host password | check [host]
+  key [public|private] [identity]
+
+Receiver is a name of the contact or a public key.
+Body is read from stdin if it is '-' or missing.
+Password is taken from the environment variable %s,
+without it the first line of stdin is the password.
+
+Options:
+`, filepath.Base(os.Args[0]), PASWENV)
+	flag.PrintDefaults()
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+	os.Exit(1)
+}
+
+// Password is not taken from the arguments,
+// they are seen by other users of the system.
+func signin() (*sr.User, error) {
+	pasw, ok := os.LookupEnv(PASWENV)
+	if !ok {
+		line, err := STDIN.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("password is null")
+		}
+		pasw = strings.TrimRight(line, "\r\n")
+	}
+	user := DATABASE.GetUser(*USERNAME, pasw)
+	if user == nil {
+		return nil, fmt.Errorf("username of password incorrect")
+	}
+	if !DATABASE.CheckTOTP(user, *TOTPCODE) {
+		return nil, fmt.Errorf("two-factor code incorrect")
+	}
+	err := DATABASE.UpgradeKDF(user, pasw)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Errors of the connections are printed,
+// the email is sent if one node accepted it.
+func sendCommand(user *sr.User, args []string) error {
+	fset := flag.NewFlagSet("send", flag.ExitOnError)
+	from := fset.String("from", "", "name of the identity (default account)")
+	fset.Parse(args)
+	args = fset.Args()
+	if len(args) < 2 {
+		return fmt.Errorf("receiver or head is null")
+	}
+	recv := getReceiver(user, args[0])
+	if recv == nil {
+		return fmt.Errorf("receiver is null")
+	}
+	sender := getIdentity(user, *from)
+	if sender == nil {
+		return fmt.Errorf("sender is null")
+	}
+	head := strings.TrimSpace(args[1])
+	body := "-"
+	if len(args) > 2 {
+		body = args[2]
+	}
+	if body == "-" {
+		data, err := ioutil.ReadAll(STDIN)
+		if err != nil {
+			return fmt.Errorf("read stdin")
+		}
+		body = string(data)
+	}
+	body = strings.TrimSpace(body)
+	if head == "" || body == "" {
+		return fmt.Errorf("head or body is null")
+	}
+	for i := 3; i < len(args); i++ {
+		content, err := ioutil.ReadFile(args[i])
+		if err != nil {
+			return fmt.Errorf("read file '%s'", args[i])
+		}
+		head += pr.FSEPARAT + filepath.Base(args[i])
+		body += pr.FSEPARAT + en.Base64Encode(content)
+	}
+	pack, err := pr.NewPackage(sender.Priv, recv, pr.NewEmail(sender.Name, head, body))
+	if err != nil {
+		return err
+	}
+	conns := DATABASE.GetConns(user)
+	if len(conns) == 0 {
+		return fmt.Errorf("connections is null")
+	}
+	sent := 0
+	for _, conn := range conns {
+		err := pr.Send(context.Background(), st.HTCLIENT, conn, recv, pack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", conn[0], err.Error())
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return fmt.Errorf("email not sent")
+	}
+	if !DATABASE.IsVerified(user, recv) {
+		fmt.Fprintln(os.Stderr, "warning: receiver's key is not verified")
+	}
+	fmt.Printf("email sent to %d of %d nodes\n", sent, len(conns))
+	return nil
+}
+
+// Keys are the same as in the web interface:
+// main, old during the grace period and identities.
+func fetchCommand(user *sr.User, args []string) error {
+	count := 0
+	for _, conn := range DATABASE.GetConns(user) {
+		n, err := DATABASE.LoadEmails(context.Background(), st.HTCLIENT, user, conn[0], MAXCOUNT, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", conn[0], err.Error())
+		}
+		count += n
+	}
+	fmt.Printf("%d new messages\n", count)
+	return nil
+}
+
+// hash  time  sender  head
+func listCommand(user *sr.User, args []string) error {
+	page := 0
+	if len(args) > 0 {
+		num, err := strconv.Atoi(args[0])
+		if err != nil || num < 0 {
+			return fmt.Errorf("page is not number")
+		}
+		page = num
+	}
+	for _, email := range DATABASE.GetEmails(user, page*MAXEPAGE, MAXEPAGE) {
+		fmt.Printf("%s\t%s\t%s\t%s\n",
+			email.Hash, email.Time, cleanLine(getSender(&email)), cleanLine(email.Head))
+	}
+	return nil
+}
+
+func readCommand(user *sr.User, args []string) error {
+	fset := flag.NewFlagSet("read", flag.ExitOnError)
+	save := fset.String("save", "", "directory for the attached files")
+	fset.Parse(args)
+	args = fset.Args()
+	if len(args) != 1 {
+		return fmt.Errorf("hash is null")
+	}
+	email := DATABASE.GetEmailByHash(user, args[0])
+	if email == nil {
+		return fmt.Errorf("email undefined")
+	}
+	fmt.Printf("From: %s\nKey: %s\n", cleanLine(getSender(email)), email.SenderPubl)
+	if email.Identity != "" {
+		fmt.Printf("To: %s\n", cleanLine(email.Identity))
+	}
+	fmt.Printf("Time: %s\nHead: %s\n\n%s\n", email.Time, cleanLine(email.Head), cleanText(email.Body))
+	for _, file := range email.Files {
+		content := en.Base64Decode(file[1])
+		fmt.Printf("\nFile: %s (%d bytes)", cleanLine(file[0]), len(content))
+		if *save == "" {
+			continue
+		}
+		path := filepath.Join(*save, filepath.Base(file[0]))
+		err := ioutil.WriteFile(path, content, 0600)
+		if err != nil {
+			return fmt.Errorf("write file '%s'", path)
+		}
+		fmt.Printf(" -> %s", path)
+	}
+	if len(email.Files) != 0 {
+		fmt.Println()
+	}
+	return nil
+}
+
+func contactsCommand(user *sr.User, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, contact := range DATABASE.GetContacts(user) {
+			verified := ""
+			if contact.Verified {
+				verified = "\tverified"
+			}
+			fmt.Printf("%s\t%s%s\n", cleanLine(contact.Name), contact.Publ, verified)
+		}
+		return nil
+	case args[0] == "add" && len(args) == 3:
+		pub := pr.LoadPubKeyByString(args[2])
+		if pub == nil {
+			return fmt.Errorf("public key is null")
+		}
+		err := DATABASE.SetContact(user, strings.TrimSpace(args[1]), pub)
+		if err != nil {
+			return err
+		}
+		fmt.Println("contact append")
+		return nil
+	case args[0] == "del" && len(args) == 2:
+		pub := getReceiver(user, args[1])
+		if pub == nil || !DATABASE.InContacts(user, pub) {
+			return fmt.Errorf("contact undefined")
+		}
+		err := DATABASE.DelContact(user, pub)
+		if err != nil {
+			return err
+		}
+		fmt.Println("contact deleted")
+		return nil
+	}
+	return fmt.Errorf("unknown arguments of contacts")
+}
+
+func connectsCommand(user *sr.User, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, conn := range DATABASE.GetConns(user) {
+			fmt.Println(conn[0])
+		}
+		return nil
+	case args[0] == "add" && len(args) == 3:
+		err := DATABASE.SetConn(user, strings.TrimSpace(args[1]), args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Println("connect append")
+		return nil
+	case args[0] == "check" && len(args) <= 2:
+		failed := 0
+		for _, conn := range DATABASE.GetConns(user) {
+			if len(args) == 2 && conn[0] != args[1] {
+				continue
+			}
+			err := pr.Check(context.Background(), st.HTCLIENT, conn)
+			if err != nil {
+				fmt.Printf("%s\terror: %s\n", conn[0], err.Error())
+				failed++
+				continue
+			}
+			fmt.Printf("%s\tok\n", conn[0])
+		}
+		if failed != 0 {
+			return fmt.Errorf("%d connections failed", failed)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown arguments of connects")
+}
+
+func keyCommand(user *sr.User, args []string) error {
+	kind := "public"
+	if len(args) > 0 {
+		kind = args[0]
+	}
+	name := ""
+	if len(args) > 1 {
+		name = args[1]
+	}
+	identity := getIdentity(user, name)
+	if identity == nil {
+		return fmt.Errorf("identity undefined")
+	}
+	switch kind {
+	case "public":
+		fmt.Println(identity.Priv.PubKey().String())
+	case "private":
+		fmt.Println(identity.Priv.String())
+	default:
+		return fmt.Errorf("unknown kind of key '%s'", kind)
+	}
+	return nil
+}
+
+// The main key goes under the account name.
+func getIdentity(user *sr.User, name string) *sr.Identity {
+	if name == "" || name == user.Name {
+		return &sr.Identity{Name: user.Name, Priv: user.Priv()}
+	}
+	for _, identity := range user.Identities() {
+		if identity.Name == name {
+			return &identity
+		}
+	}
+	return nil
+}
+
+func getReceiver(user *sr.User, arg string) cr.PubKey {
+	if pub := pr.LoadPubKeyByString(arg); pub != nil {
+		return pub
+	}
+	for _, contact := range DATABASE.GetContacts(user) {
+		if contact.Name == arg {
+			return pr.LoadPubKeyByString(contact.Publ)
+		}
+	}
+	return nil
+}
+
+// Texts of emails are written by the senders, control
+// characters are removed to not change the terminal.
+func cleanText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func cleanLine(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func getSender(email *sr.Email) string {
+	if email.Contact != "" {
+		return email.Contact
+	}
+	return email.SenderName
+}
@@ -0,0 +1,46 @@
+// Package hestest contains helpers shared by the tests of packages.
+package hestest
+
+import (
+	"os"
+	"testing"
+
+	cr "github.com/number571/go-peer/crypto"
+	lc "github.com/number571/go-peer/local"
+	gp "github.com/number571/go-peer/settings"
+
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+	sr "github.com/number571/hes/storage"
+)
+
+// Passwords of accounts and archives are hardened by
+// the parameters of the database, they are cheap in tests.
+const (
+	KDF = "argon2id:1:1024:1"
+)
+
+// Packages are created without the proof of work.
+func Main(m *testing.M) {
+	st.SETTINGS.Set(gp.SizeWork, 1)
+	os.Exit(m.Run())
+}
+
+func NewUser(t testing.TB, db *sr.DB, name, pasw string, priv cr.PrivKey) *sr.User {
+	t.Helper()
+	err := db.SetUser(name, pasw, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := db.GetUser(name, pasw)
+	if user == nil {
+		t.Fatal("user is not loaded")
+	}
+	return user
+}
+
+// The package is decrypted as by the loading from nodes.
+func NewEmail(sender, recv cr.PrivKey, head, body string) lc.Message {
+	pack := pr.NewMessenger(sender).Encrypt(recv.PubKey(), pr.NewEmail("sender", head, body))
+	return pr.NewMessenger(recv).Decrypt(pack)
+}
@@ -0,0 +1,285 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	cr "github.com/number571/go-peer/crypto"
+	st "github.com/number571/hes/settings"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	_ cr.PrivKey = &PrivKeyX25519{}
+	_ cr.PubKey  = &PubKeyX25519{}
+)
+
+// Key types selectable at signup.
+// RSA keys keep the format of go-peer.
+var KEYTYPES = []string{
+	"rsa-2048",
+	"rsa-3072",
+	"rsa-4096",
+	"x25519",
+}
+
+const (
+	X25519TYPE = "hes\\x25519-ed25519"
+	X25519SIZE = 256 // bits
+)
+
+// X25519 is used for encryption, Ed25519 for signatures.
+// bytes(priv) = x25519_scalar || ed25519_seed
+// bytes(pub)  = x25519_point  || ed25519_point
+type PrivKeyX25519 struct {
+	dh   []byte
+	sign ed25519.PrivateKey
+}
+
+type PubKeyX25519 struct {
+	dh   []byte
+	sign ed25519.PublicKey
+}
+
+func NewPrivKey(ktype string) cr.PrivKey {
+	switch ktype {
+	case "", "rsa":
+		return cr.NewPrivKey(st.AKEYSIZE)
+	case "rsa-2048":
+		return cr.NewPrivKey(2048)
+	case "rsa-3072":
+		return cr.NewPrivKey(3072)
+	case "rsa-4096":
+		return cr.NewPrivKey(4096)
+	case "x25519":
+		return newPrivKeyX25519()
+	}
+	return nil
+}
+
+// New key of the same type and size.
+func RenewPrivKey(priv cr.PrivKey) cr.PrivKey {
+	if priv.Type() == X25519TYPE {
+		return newPrivKeyX25519()
+	}
+	return cr.NewPrivKey(priv.Size())
+}
+
+// Keys of the both types are recognized by the prefix
+// of the string and by the length of the bytes.
+func LoadPrivKey(pbytes []byte) cr.PrivKey {
+	if len(pbytes) == 2*ed25519.SeedSize {
+		return loadPrivKeyX25519(pbytes)
+	}
+	priv := cr.LoadPrivKey(pbytes)
+	if !validKeyRSA(priv) {
+		return nil
+	}
+	return priv
+}
+
+func LoadPubKey(pbytes []byte) cr.PubKey {
+	if len(pbytes) == 2*ed25519.PublicKeySize {
+		return loadPubKeyX25519(pbytes)
+	}
+	pub := cr.LoadPubKey(pbytes)
+	if !validKeyRSA(pub) {
+		return nil
+	}
+	return pub
+}
+
+func LoadPrivKeyByString(pstring string) cr.PrivKey {
+	pbytes := decodeKeyString("Priv", X25519TYPE, pstring)
+	if pbytes != nil {
+		return loadPrivKeyX25519(pbytes)
+	}
+	priv := cr.LoadPrivKeyByString(pstring)
+	if !validKeyRSA(priv) {
+		return nil
+	}
+	return priv
+}
+
+func LoadPubKeyByString(pstring string) cr.PubKey {
+	pbytes := decodeKeyString("Pub", X25519TYPE, pstring)
+	if pbytes != nil {
+		return loadPubKeyX25519(pbytes)
+	}
+	pub := cr.LoadPubKeyByString(pstring)
+	if !validKeyRSA(pub) {
+		return nil
+	}
+	return pub
+}
+
+func newPrivKeyX25519() cr.PrivKey {
+	return loadPrivKeyX25519(cr.RandBytes(2 * ed25519.SeedSize))
+}
+
+func loadPrivKeyX25519(pbytes []byte) cr.PrivKey {
+	if len(pbytes) != 2*ed25519.SeedSize {
+		return nil
+	}
+	return &PrivKeyX25519{
+		dh:   append([]byte{}, pbytes[:curve25519.ScalarSize]...),
+		sign: ed25519.NewKeyFromSeed(pbytes[curve25519.ScalarSize:]),
+	}
+}
+
+// sender = x25519_point(ephemeral)
+// key    = hash(x25519(ephemeral, receiver) || sender || receiver)
+// data   = sender || encrypt[key](msg)
+func (key *PrivKeyX25519) Decrypt(msg []byte) []byte {
+	if len(msg) < curve25519.PointSize {
+		return nil
+	}
+	epub := msg[:curve25519.PointSize]
+	shared, err := curve25519.X25519(key.dh, epub)
+	if err != nil {
+		return nil
+	}
+	skey := cr.NewHasher(bytes.Join(
+		[][]byte{shared, epub, key.pubDH()},
+		[]byte{},
+	)).Bytes()
+	return cr.NewCipher(skey).Decrypt(msg[curve25519.PointSize:])
+}
+
+func (key *PrivKeyX25519) Sign(msg []byte) []byte {
+	return ed25519.Sign(key.sign, cr.NewHasher(msg).Bytes())
+}
+
+func (key *PrivKeyX25519) PubKey() cr.PubKey {
+	return &PubKeyX25519{
+		dh:   key.pubDH(),
+		sign: key.sign.Public().(ed25519.PublicKey),
+	}
+}
+
+func (key *PrivKeyX25519) Bytes() []byte {
+	return bytes.Join(
+		[][]byte{key.dh, key.sign.Seed()},
+		[]byte{},
+	)
+}
+
+func (key *PrivKeyX25519) String() string {
+	return fmt.Sprintf("Priv(%s){%X}", X25519TYPE, key.Bytes())
+}
+
+func (key *PrivKeyX25519) Type() string {
+	return X25519TYPE
+}
+
+func (key *PrivKeyX25519) Size() uint64 {
+	return X25519SIZE
+}
+
+// Zeroes the key in memory, it can not be used after.
+func (key *PrivKeyX25519) Wipe() {
+	for _, data := range [][]byte{key.dh, key.sign} {
+		for i := range data {
+			data[i] = 0
+		}
+	}
+}
+
+func (key *PrivKeyX25519) pubDH() []byte {
+	pub, err := curve25519.X25519(key.dh, curve25519.Basepoint)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+func loadPubKeyX25519(pbytes []byte) cr.PubKey {
+	if len(pbytes) != 2*ed25519.PublicKeySize {
+		return nil
+	}
+	return &PubKeyX25519{
+		dh:   append([]byte{}, pbytes[:curve25519.PointSize]...),
+		sign: append(ed25519.PublicKey{}, pbytes[curve25519.PointSize:]...),
+	}
+}
+
+func (key *PubKeyX25519) Encrypt(msg []byte) []byte {
+	epriv := cr.RandBytes(curve25519.ScalarSize)
+	epub, err := curve25519.X25519(epriv, curve25519.Basepoint)
+	if err != nil {
+		return nil
+	}
+	shared, err := curve25519.X25519(epriv, key.dh)
+	if err != nil {
+		return nil
+	}
+	skey := cr.NewHasher(bytes.Join(
+		[][]byte{shared, epub, key.dh},
+		[]byte{},
+	)).Bytes()
+	return bytes.Join(
+		[][]byte{epub, cr.NewCipher(skey).Encrypt(msg)},
+		[]byte{},
+	)
+}
+
+func (key *PubKeyX25519) Address() string {
+	return cr.NewHasher(key.Bytes()).String()
+}
+
+func (key *PubKeyX25519) Verify(msg []byte, sig []byte) bool {
+	return ed25519.Verify(key.sign, cr.NewHasher(msg).Bytes(), sig)
+}
+
+func (key *PubKeyX25519) Bytes() []byte {
+	return bytes.Join(
+		[][]byte{key.dh, key.sign},
+		[]byte{},
+	)
+}
+
+func (key *PubKeyX25519) String() string {
+	return fmt.Sprintf("Pub(%s){%X}", X25519TYPE, key.Bytes())
+}
+
+func (key *PubKeyX25519) Type() string {
+	return X25519TYPE
+}
+
+func (key *PubKeyX25519) Size() uint64 {
+	return X25519SIZE
+}
+
+// Format = Kind(type){HEX}
+func decodeKeyString(kind, ktype, pstring string) []byte {
+	var (
+		prefix = fmt.Sprintf("%s(%s){", kind, ktype)
+		suffix = "}"
+	)
+	if !strings.HasPrefix(pstring, prefix) {
+		return nil
+	}
+	if !strings.HasSuffix(pstring, suffix) {
+		return nil
+	}
+	pstring = strings.TrimPrefix(pstring, prefix)
+	pstring = strings.TrimSuffix(pstring, suffix)
+	pbytes, err := hex.DecodeString(pstring)
+	if err != nil {
+		return nil
+	}
+	return pbytes
+}
+
+// go-peer loads RSA keys without checking the result.
+func validKeyRSA(key cr.Converter) (valid bool) {
+	defer func() {
+		if recover() != nil {
+			valid = false
+		}
+	}()
+	return key != nil && key.Bytes() != nil
+}
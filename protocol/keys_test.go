@@ -0,0 +1,112 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	pr "github.com/number571/hes/protocol"
+)
+
+func TestNewPrivKey(t *testing.T) {
+	tests := []struct {
+		ktype string
+		ptype string
+		size  uint64
+	}{
+		{"rsa-2048", "go-peer\\rsa", 2048},
+		{"x25519", pr.X25519TYPE, pr.X25519SIZE},
+		{"dsa", "", 0},
+	}
+	for _, tt := range tests {
+		priv := pr.NewPrivKey(tt.ktype)
+		if tt.size == 0 {
+			if priv != nil {
+				t.Errorf("%s: key of unknown type is created", tt.ktype)
+			}
+			continue
+		}
+		if priv == nil {
+			t.Fatalf("%s: key is null", tt.ktype)
+		}
+		if priv.Type() != tt.ptype || priv.Size() != tt.size {
+			t.Errorf("%s: type %s, size %d", tt.ktype, priv.Type(), priv.Size())
+		}
+		renew := pr.RenewPrivKey(priv)
+		if renew.Type() != priv.Type() || renew.Size() != priv.Size() {
+			t.Errorf("%s: renewed key has other type or size", tt.ktype)
+		}
+		if bytes.Equal(renew.Bytes(), priv.Bytes()) {
+			t.Errorf("%s: renewed key is the same", tt.ktype)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	for _, ktype := range []string{"rsa-2048", "x25519"} {
+		priv := pr.NewPrivKey(ktype)
+		pub := priv.PubKey()
+		if lpriv := pr.LoadPrivKey(priv.Bytes()); lpriv == nil || lpriv.String() != priv.String() {
+			t.Errorf("%s: private key is not loaded by bytes", ktype)
+		}
+		if lpriv := pr.LoadPrivKeyByString(priv.String()); lpriv == nil || lpriv.String() != priv.String() {
+			t.Errorf("%s: private key is not loaded by string", ktype)
+		}
+		if lpub := pr.LoadPubKey(pub.Bytes()); lpub == nil || lpub.String() != pub.String() {
+			t.Errorf("%s: public key is not loaded by bytes", ktype)
+		}
+		if lpub := pr.LoadPubKeyByString(pub.String()); lpub == nil || lpub.String() != pub.String() {
+			t.Errorf("%s: public key is not loaded by string", ktype)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"Pub(go-peer\\rsa){00}",
+		"Pub(" + pr.X25519TYPE + "){00}",
+		"Pub(" + pr.X25519TYPE + "){XYZ}",
+		"Priv(go-peer\\rsa){}",
+	} {
+		if pr.LoadPubKeyByString(s) != nil || pr.LoadPrivKeyByString(s) != nil {
+			t.Errorf("key '%s' is loaded", s)
+		}
+	}
+}
+
+func TestX25519(t *testing.T) {
+	priv := pr.NewPrivKey("x25519")
+	other := pr.NewPrivKey("x25519")
+	msg := []byte("hello, world")
+	tests := []struct {
+		name string
+		ok   bool
+		sign func() []byte
+		data []byte
+	}{
+		{"valid", true, func() []byte { return priv.Sign(msg) }, msg},
+		{"other data", false, func() []byte { return priv.Sign(msg) }, []byte("hello")},
+		{"other key", false, func() []byte { return other.Sign(msg) }, msg},
+		{"null", false, func() []byte { return nil }, msg},
+	}
+	for _, tt := range tests {
+		if priv.PubKey().Verify(tt.data, tt.sign()) != tt.ok {
+			t.Errorf("%s: verify != %v", tt.name, tt.ok)
+		}
+	}
+	encd := priv.PubKey().Encrypt(msg)
+	if !bytes.Equal(priv.Decrypt(encd), msg) {
+		t.Errorf("message is not decrypted")
+	}
+	if bytes.Equal(other.Decrypt(encd), msg) {
+		t.Errorf("message is decrypted by other key")
+	}
+	if priv.Decrypt(encd[:10]) != nil {
+		t.Errorf("short message is decrypted")
+	}
+}
+
+func TestWipe(t *testing.T) {
+	priv := pr.NewPrivKey("x25519").(*pr.PrivKeyX25519)
+	priv.Wipe()
+	if !bytes.Equal(priv.Bytes()[:32], make([]byte, 32)) {
+		t.Errorf("key is not wiped")
+	}
+}
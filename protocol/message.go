@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+	gp "github.com/number571/go-peer/settings"
+	st "github.com/number571/hes/settings"
+)
+
+// The format of packages is the same as in go-peer,
+// but keys of any type and size can be mixed.
+type Messenger interface {
+	Encrypt(recv cr.PubKey, msg lc.Message) lc.Message
+	Decrypt(pack lc.Message) lc.Message
+}
+
+type MessengerT struct {
+	priv cr.PrivKey
+}
+
+func NewMessenger(priv cr.PrivKey) Messenger {
+	if priv == nil {
+		return nil
+	}
+	return &MessengerT{
+		priv: priv,
+	}
+}
+
+// hash = hash(session || sender || receiver || data)
+func (mgr *MessengerT) Encrypt(recv cr.PubKey, msg lc.Message) lc.Message {
+	var (
+		session = cr.RandBytes(st.SETTINGS.Get(gp.SizeSkey))
+		cipher  = cr.NewCipher(session)
+		publ    = mgr.priv.PubKey().Bytes()
+	)
+	data := bytes.Join(
+		[][]byte{
+			en.Uint64ToBytes(uint64(len(msg.Body.Data))),
+			msg.Body.Data,
+			en.Uint64ToBytes(cr.RandUint64() % (gp.SizePack / 4)),
+		},
+		[]byte{},
+	)
+	hash := cr.NewHasher(bytes.Join(
+		[][]byte{
+			session,
+			publ,
+			recv.Bytes(),
+			data,
+		},
+		[]byte{},
+	)).Bytes()
+	esession := recv.Encrypt(session)
+	if esession == nil {
+		return nil
+	}
+	return &lc.MessageT{
+		Head: lc.HeadMessage{
+			Sender:  cipher.Encrypt(publ),
+			Session: esession,
+		},
+		Body: lc.BodyMessage{
+			Data: cipher.Encrypt(data),
+			Hash: hash,
+			Sign: cipher.Encrypt(mgr.priv.Sign(hash)),
+			Npow: cr.NewPuzzle(st.SETTINGS.Get(gp.SizeWork)).Proof(hash),
+		},
+	}
+}
+
+func (mgr *MessengerT) Decrypt(pack lc.Message) lc.Message {
+	const (
+		SizeUint64 = 8 // bytes
+	)
+	hash := pack.Body.Hash
+	puzzle := cr.NewPuzzle(st.SETTINGS.Get(gp.SizeWork))
+	if !puzzle.Verify(hash, pack.Body.Npow) {
+		return nil
+	}
+	session := mgr.priv.Decrypt(pack.Head.Session)
+	if session == nil {
+		return nil
+	}
+	cipher := cr.NewCipher(session)
+	publ := cipher.Decrypt(pack.Head.Sender)
+	if publ == nil {
+		return nil
+	}
+	sender := LoadPubKey(publ)
+	if sender == nil {
+		return nil
+	}
+	sign := cipher.Decrypt(pack.Body.Sign)
+	if sign == nil || !sender.Verify(hash, sign) {
+		return nil
+	}
+	data := cipher.Decrypt(pack.Body.Data)
+	if data == nil {
+		return nil
+	}
+	check := cr.NewHasher(bytes.Join(
+		[][]byte{
+			session,
+			publ,
+			mgr.priv.PubKey().Bytes(),
+			data,
+		},
+		[]byte{},
+	)).Bytes()
+	if !bytes.Equal(check, hash) {
+		return nil
+	}
+	if len(data) < SizeUint64 {
+		return nil
+	}
+	size := en.BytesToUint64(data[:SizeUint64])
+	data = data[SizeUint64:]
+	if size > uint64(len(data)) {
+		return nil
+	}
+	return &lc.MessageT{
+		Head: lc.HeadMessage{
+			Sender:  publ,
+			Session: session,
+		},
+		Body: lc.BodyMessage{
+			Data: data[:size],
+			Hash: hash,
+			Sign: sign,
+			Npow: pack.Body.Npow,
+		},
+	}
+}
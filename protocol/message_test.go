@@ -0,0 +1,98 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	cr "github.com/number571/go-peer/crypto"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+)
+
+func TestMain(m *testing.M) {
+	hestest.Main(m)
+}
+
+func TestMessenger(t *testing.T) {
+	var (
+		rsa    = pr.NewPrivKey("rsa-2048")
+		x25519 = pr.NewPrivKey("x25519")
+	)
+	tests := []struct {
+		name   string
+		sender cr.PrivKey
+		recv   cr.PrivKey
+	}{
+		{"rsa to rsa", rsa, rsa},
+		{"x25519 to x25519", x25519, x25519},
+		{"rsa to x25519", rsa, x25519},
+		{"x25519 to rsa", x25519, rsa},
+	}
+	for _, tt := range tests {
+		msg := pr.NewEmail("sender", "head", "body")
+		pack := pr.NewMessenger(tt.sender).Encrypt(tt.recv.PubKey(), msg)
+		if pack == nil {
+			t.Fatalf("%s: package is null", tt.name)
+		}
+		dec := pr.NewMessenger(tt.recv).Decrypt(pack)
+		if dec == nil {
+			t.Fatalf("%s: package is not decrypted", tt.name)
+		}
+		if !bytes.Equal(dec.Body.Data, msg.Body.Data) {
+			t.Errorf("%s: data is changed", tt.name)
+		}
+		if !bytes.Equal(dec.Head.Sender, tt.sender.PubKey().Bytes()) {
+			t.Errorf("%s: sender is changed", tt.name)
+		}
+		if !bytes.Equal(dec.Body.Hash, pack.Body.Hash) {
+			t.Errorf("%s: hash is changed", tt.name)
+		}
+		other := pr.RenewPrivKey(tt.recv)
+		if pr.NewMessenger(other).Decrypt(pack) != nil {
+			t.Errorf("%s: package is decrypted by other key", tt.name)
+		}
+	}
+	if pr.NewMessenger(nil) != nil {
+		t.Errorf("messenger without key is created")
+	}
+}
+
+func TestMessengerDamaged(t *testing.T) {
+	priv := pr.NewPrivKey("x25519")
+	tests := []struct {
+		name   string
+		damage func(pack *[4][]byte)
+	}{
+		{"data", func(pack *[4][]byte) { pack[0][0] ^= 1 }},
+		{"hash", func(pack *[4][]byte) { pack[1][0] ^= 1 }},
+		{"sign", func(pack *[4][]byte) { pack[2][0] ^= 1 }},
+		{"sender", func(pack *[4][]byte) { pack[3][0] ^= 1 }},
+	}
+	for _, tt := range tests {
+		pack := pr.NewMessenger(priv).Encrypt(priv.PubKey(), pr.NewEmail("sender", "head", "body"))
+		tt.damage(&[4][]byte{pack.Body.Data, pack.Body.Hash, pack.Body.Sign, pack.Head.Sender})
+		if pr.NewMessenger(priv).Decrypt(pack) != nil {
+			t.Errorf("%s: damaged package is decrypted", tt.name)
+		}
+	}
+}
+
+func TestMAC(t *testing.T) {
+	data := []byte("hash of package")
+	macp := pr.NewMAC("password", data)
+	tests := []struct {
+		pasw string
+		data []byte
+		ok   bool
+	}{
+		{"password", data, true},
+		{"other", data, false},
+		{"password", []byte("other"), false},
+	}
+	for _, tt := range tests {
+		if pr.CheckMAC(tt.pasw, macp, tt.data) != tt.ok {
+			t.Errorf("%s/%s: check != %v", tt.pasw, tt.data, tt.ok)
+		}
+	}
+}
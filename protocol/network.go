@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+	gp "github.com/number571/go-peer/settings"
+
+	st "github.com/number571/hes/settings"
+)
+
+// The message is encrypted by the private key
+// of the sender for the public key of the receiver.
+func NewPackage(priv cr.PrivKey, recv cr.PubKey, msg lc.Message) (lc.Message, error) {
+	pack := NewMessenger(priv).Encrypt(recv, msg)
+	if pack == nil {
+		return nil, fmt.Errorf("encrypt message")
+	}
+	if uint64(len(pack.Serialize())) > st.SETTINGS.Get(gp.SizePack) {
+		return nil, fmt.Errorf("max size")
+	}
+	return pack, nil
+}
+
+// Connection = [host, password].
+func Send(ctx context.Context, hc *http.Client, conn [2]string, recv cr.PubKey, pack lc.Message) error {
+	return Forward(ctx, hc, conn, string(recv.Address()), pack)
+}
+
+// Receiver = hash(public_key), nodes know only it.
+func Forward(ctx context.Context, hc *http.Client, conn [2]string, recv string, pack lc.Message) error {
+	_, err := request(ctx, hc, conn[0], "/email/send", SendRequest{
+		Recv: recv,
+		Data: string(pack.Serialize()),
+		Macp: NewMAC(conn[1], pack.Body.Hash),
+	})
+	return err
+}
+
+// Packages are loaded for the public key of the receiver
+// and passed to the handler after decryption.
+// Loading stops after max handled packages,
+// zero means that all packages are loaded.
+func Load(ctx context.Context, hc *http.Client, addr string, priv cr.PrivKey, max int, handle func(lc.Message) error) error {
+	client := NewMessenger(priv)
+	recv := string(priv.PubKey().Address())
+	result, err := request(ctx, hc, addr, "/email/recv", LoadRequest{
+		Recv: recv,
+		Data: 0,
+	})
+	if err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(result)
+	if err != nil {
+		return fmt.Errorf("size is not number")
+	}
+	for i, count := 1, 0; i <= size && (max == 0 || count < max); i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		result, err := request(ctx, hc, addr, "/email/recv", LoadRequest{
+			Recv: recv,
+			Data: i,
+		})
+		if err != nil {
+			continue
+		}
+		pack := lc.Package(result).Deserialize()
+		if pack == nil {
+			continue
+		}
+		pack = client.Decrypt(pack)
+		if pack == nil {
+			continue
+		}
+		if handle(pack) == nil {
+			count++
+		}
+	}
+	return nil
+}
+
+// The node accepts the connection if the password is valid.
+func Check(ctx context.Context, hc *http.Client, conn [2]string) error {
+	macp := en.Uint64ToBytes(st.SETTINGS.Get(gp.MaskRout))
+	_, err := request(ctx, hc, conn[0], "/", CheckRequest{
+		Macp: NewMAC(conn[1], macp),
+	})
+	return err
+}
+
+func request(ctx context.Context, hc *http.Client, addr, path string, req interface{}) (string, error) {
+	var servresp Response
+	hreq, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		strings.TrimRight(addr, " /")+path,
+		bytes.NewReader(st.Serialize(req)),
+	)
+	if err != nil {
+		return "", fmt.Errorf("address is not valid")
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(hreq)
+	if err != nil {
+		return "", fmt.Errorf("connect")
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
+		return "", fmt.Errorf("max size")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&servresp)
+	if err != nil {
+		return "", fmt.Errorf("parse json")
+	}
+	if servresp.Return != 0 {
+		return "", fmt.Errorf("%s", servresp.Result)
+	}
+	return servresp.Result, nil
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"bytes"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+
+	st "github.com/number571/hes/settings"
+)
+
+const (
+	FSEPARAT  = "\001\007\005\000\005\007\001"
+	IS_EMAIL  = "[IS-EMAIL]"
+	IS_ROTATE = "[IS-ROTATE]"
+)
+
+// Head and body hold the attached files
+// after FSEPARAT as name and base64 content.
+type Email struct {
+	SenderName string
+	Head       string
+	Body       string
+}
+
+type Rotation struct {
+	NewPubl string
+	Sign    string
+}
+
+type SendRequest struct {
+	Recv string `json:"recv"`
+	Data string `json:"data"`
+	Macp string `json:"macp"`
+}
+
+type LoadRequest struct {
+	Recv string `json:"recv"`
+	Data int    `json:"data"`
+}
+
+type CheckRequest struct {
+	Macp string `json:"macp"`
+}
+
+type Response struct {
+	Result string `json:"result"`
+	Return int    `json:"return"`
+}
+
+func NewEmail(sender, head, body string) lc.Message {
+	return lc.NewMessage([]byte(IS_EMAIL), st.Serialize(Email{
+		SenderName: sender,
+		Head:       head,
+		Body:       body,
+	}))
+}
+
+// sign = sign[new_private_key](hash(old_public_key || new_public_key))
+func NewRotation(oldpriv, newpriv cr.PrivKey) lc.Message {
+	hash := cr.NewHasher(bytes.Join(
+		[][]byte{
+			oldpriv.PubKey().Bytes(),
+			newpriv.PubKey().Bytes(),
+		},
+		[]byte{},
+	)).Bytes()
+	return lc.NewMessage([]byte(IS_ROTATE), st.Serialize(Rotation{
+		NewPubl: newpriv.PubKey().String(),
+		Sign:    en.Base64Encode(newpriv.Sign(hash)),
+	}))
+}
+
+// macp = encrypt[hash(password)](data)
+func NewMAC(pasw string, data []byte) string {
+	key := cr.NewHasher([]byte(pasw)).Bytes()
+	return en.Base64Encode(cr.NewCipher(key).Encrypt(data))
+}
+
+func CheckMAC(pasw, macp string, data []byte) bool {
+	key := cr.NewHasher([]byte(pasw)).Bytes()
+	return bytes.Equal(cr.NewCipher(key).Decrypt(en.Base64Decode(macp)), data)
+}
@@ -1,4 +1,4 @@
-package main
+package relay
 
 import (
 	"database/sql"
@@ -51,6 +51,18 @@ func (db *DB) SetEmail(recv string, pack lc.Message) error {
 	return err
 }
 
+// Packages of the mesh come again from other nodes.
+func (db *DB) Exist(pack lc.Message) bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var id int
+	row := db.ptr.QueryRow(
+		"SELECT id FROM emails WHERE hash=$1",
+		en.Base64Encode(pack.Body.Hash),
+	)
+	return row.Scan(&id) == nil
+}
+
 func (db *DB) GetEmail(id int, recv string) string {
 	db.mtx.Lock()
 	defer db.mtx.Unlock()
@@ -74,6 +86,22 @@ func (db *DB) DelEmailsByTime(t time.Duration) error {
 	return err
 }
 
+func (db *DB) Count() int {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var data int
+	row := db.ptr.QueryRow("SELECT COUNT(*) FROM emails")
+	row.Scan(&data)
+	return data
+}
+
+func (db *DB) Ping() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var data int
+	return db.ptr.QueryRow("SELECT 1").Scan(&data)
+}
+
 func (db *DB) Size(recv string) int {
 	db.mtx.Lock()
 	defer db.mtx.Unlock()
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counters in the text format of Prometheus,
+// series = name{label="value",...}.
+type Metrics struct {
+	mtx    sync.Mutex
+	series map[string]uint64
+}
+
+var metricsHelp = map[string]string{
+	"hes_emails":               "Packages stored by the node.",
+	"hes_send_accepted_total":  "Packages accepted by the node.",
+	"hes_send_rejected_total":  "Packages rejected by the node by reason.",
+	"hes_recv_requests_total":  "Requests for size and data of packages.",
+	"hes_check_requests_total": "Requests for check of connection.",
+	"hes_relay_total":          "Packages sent to the connections of the node.",
+	"hes_purge_runs_total":     "Deletions of old packages.",
+	"hes_purge_errors_total":   "Failed deletions of old packages.",
+}
+
+// Reasons are the codes of responses of /email/send.
+var sendReasons = map[int]string{
+	1: "method",
+	2: "max_size",
+	3: "parse_json",
+	4: "deserialize",
+	5: "proof_of_work",
+	6: "mac",
+	7: "save",
+	8: "duplicate",
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		series: make(map[string]uint64),
+	}
+}
+
+func (metrics *Metrics) Inc(name string, labels ...string) {
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	metrics.series[formatSeries(name, labels)]++
+}
+
+func (metrics *Metrics) Write(w http.ResponseWriter, gauges map[string]uint64) {
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	series := make(map[string]uint64, len(metrics.series)+len(gauges))
+	for k, v := range metrics.series {
+		series[k] = v
+	}
+	for k, v := range gauges {
+		series[k] = v
+	}
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	last := ""
+	for _, k := range keys {
+		name := strings.SplitN(k, "{", 2)[0]
+		if name != last {
+			kind := "counter"
+			if _, ok := gauges[k]; ok {
+				kind = "gauge"
+			}
+			if help, ok := metricsHelp[name]; ok {
+				fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+			last = name
+		}
+		fmt.Fprintf(w, "%s %d\n", k, series[k])
+	}
+}
+
+// labels = key, value, key, value...
+func formatSeries(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
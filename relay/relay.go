@@ -0,0 +1,207 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+	gp "github.com/number571/go-peer/settings"
+
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+)
+
+// Node stores packages for the receivers
+// and sends them further to the connections.
+type Relay struct {
+	db      *DB
+	cfg     *CFG
+	hc      *http.Client
+	metrics *Metrics
+}
+
+func NewRelay(db *DB, cfg *CFG, hc *http.Client) *Relay {
+	return &Relay{
+		db:      db,
+		cfg:     cfg,
+		hc:      hc,
+		metrics: NewMetrics(),
+	}
+}
+
+func (relay *Relay) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", relay.indexPage)
+	mux.HandleFunc("/email/send", relay.emailSendPage)
+	mux.HandleFunc("/email/recv", relay.emailRecvPage)
+	return mux
+}
+
+// Health and metrics can be served on a separate address.
+func (relay *Relay) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", relay.healthzPage)
+	mux.HandleFunc("/readyz", relay.readyzPage)
+	mux.HandleFunc("/metrics", relay.metricsPage)
+	return mux
+}
+
+// Packages older than deltime are deleted.
+func (relay *Relay) Purge(deltime time.Duration) error {
+	relay.metrics.Inc("hes_purge_runs_total")
+	err := relay.db.DelEmailsByTime(deltime)
+	if err != nil {
+		relay.metrics.Inc("hes_purge_errors_total")
+	}
+	return err
+}
+
+func (relay *Relay) indexPage(w http.ResponseWriter, r *http.Request) {
+	var req pr.CheckRequest
+	if r.Method != "POST" {
+		response(w, 0, "hidden email service")
+		return
+	}
+	if r.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
+		response(w, 1, "error: max size")
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response(w, 2, "error: parse json")
+		return
+	}
+	if !pr.CheckMAC(relay.cfg.Pasw, req.Macp, en.Uint64ToBytes(st.SETTINGS.Get(gp.MaskRout))) {
+		relay.metrics.Inc("hes_check_requests_total", "result", "rejected")
+		response(w, 3, "error: message authentication code")
+		return
+	}
+	relay.metrics.Inc("hes_check_requests_total", "result", "accepted")
+	response(w, 0, "success: check connection")
+}
+
+func (relay *Relay) emailSendPage(w http.ResponseWriter, r *http.Request) {
+	var req pr.SendRequest
+	if r.Method != "POST" {
+		relay.sendResponse(w, 1, "error: method != POST")
+		return
+	}
+	if r.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
+		relay.sendResponse(w, 2, "error: max size")
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		relay.sendResponse(w, 3, "error: parse json")
+		return
+	}
+	pack := lc.Package(req.Data).Deserialize()
+	if pack == nil {
+		relay.sendResponse(w, 4, "error: deserialize package")
+		return
+	}
+	hash := pack.Body.Hash
+	puzzle := cr.NewPuzzle(st.SETTINGS.Get(gp.SizeWork))
+	if !puzzle.Verify(hash, pack.Body.Npow) {
+		relay.sendResponse(w, 5, "error: proof of work")
+		return
+	}
+	if !pr.CheckMAC(relay.cfg.Pasw, req.Macp, hash) {
+		relay.sendResponse(w, 6, "error: message authentication code")
+		return
+	}
+	if relay.db.Exist(pack) {
+		relay.sendResponse(w, 8, "error: email already exist")
+		return
+	}
+	err = relay.db.SetEmail(req.Recv, pack)
+	if err != nil {
+		relay.sendResponse(w, 7, "error: save email")
+		return
+	}
+	for _, conn := range relay.cfg.Conns {
+		go relay.forward(conn, req.Recv, pack)
+	}
+	relay.sendResponse(w, 0, "success: email saved")
+}
+
+func (relay *Relay) emailRecvPage(w http.ResponseWriter, r *http.Request) {
+	var req pr.LoadRequest
+	if r.Method != "POST" {
+		response(w, 1, "error: method != POST")
+		return
+	}
+	if r.ContentLength > int64(st.SETTINGS.Get(gp.SizePack)) {
+		response(w, 2, "error: max size")
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		response(w, 3, "error: parse json")
+		return
+	}
+	if req.Data == 0 {
+		relay.metrics.Inc("hes_recv_requests_total", "type", "size")
+		response(w, 0, fmt.Sprintf("%d", relay.db.Size(req.Recv)))
+		return
+	}
+	res := relay.db.GetEmail(req.Data, req.Recv)
+	if res == "" {
+		relay.metrics.Inc("hes_recv_requests_total", "type", "empty")
+		response(w, 4, "error: nothing data")
+		return
+	}
+	relay.metrics.Inc("hes_recv_requests_total", "type", "data")
+	response(w, 0, res)
+}
+
+func (relay *Relay) healthzPage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Ready if the database is reachable.
+func (relay *Relay) readyzPage(w http.ResponseWriter, r *http.Request) {
+	err := relay.db.Ping()
+	if err != nil {
+		http.Error(w, "error: database", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (relay *Relay) metricsPage(w http.ResponseWriter, r *http.Request) {
+	relay.metrics.Write(w, map[string]uint64{
+		"hes_emails": uint64(relay.db.Count()),
+	})
+}
+
+func (relay *Relay) forward(conn [2]string, recv string, pack lc.Message) {
+	err := pr.Forward(context.Background(), relay.hc, conn, recv, pack)
+	if err != nil {
+		relay.metrics.Inc("hes_relay_total", "peer", conn[0], "result", "failure")
+		return
+	}
+	relay.metrics.Inc("hes_relay_total", "peer", conn[0], "result", "success")
+}
+
+func (relay *Relay) sendResponse(w http.ResponseWriter, ret int, res string) {
+	if ret == 0 {
+		relay.metrics.Inc("hes_send_accepted_total")
+	} else {
+		relay.metrics.Inc("hes_send_rejected_total", "reason", sendReasons[ret])
+	}
+	response(w, ret, res)
+}
+
+func response(w http.ResponseWriter, ret int, res string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pr.Response{
+		Result: res,
+		Return: ret,
+	})
+}
@@ -0,0 +1,193 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lc "github.com/number571/go-peer/local"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+)
+
+func TestMain(m *testing.M) {
+	hestest.Main(m)
+}
+
+func newTestRelay(t *testing.T, conns [][2]string) (*Relay, *httptest.Server) {
+	db := NewDB(filepath.Join(t.TempDir(), "hes.db"))
+	if db == nil {
+		t.Fatal("database is null")
+	}
+	relay := NewRelay(db, &CFG{Pasw: "pasw", Conns: conns}, http.DefaultClient)
+	srv := httptest.NewServer(relay.Handler())
+	t.Cleanup(srv.Close)
+	return relay, srv
+}
+
+func TestEmailSend(t *testing.T) {
+	relay, srv := newTestRelay(t, nil)
+	priv := pr.NewPrivKey("x25519")
+	pack, err := pr.NewPackage(priv, priv.PubKey(), pr.NewEmail("sender", "head", "body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := pr.SendRequest{
+		Recv: priv.PubKey().Address(),
+		Data: string(pack.Serialize()),
+		Macp: pr.NewMAC("pasw", pack.Body.Hash),
+	}
+	tests := []struct {
+		name   string
+		method string
+		body   interface{}
+		ret    int
+	}{
+		{"method", "GET", nil, 1},
+		{"json", "POST", "{", 3},
+		{"package", "POST", pr.SendRequest{Recv: valid.Recv, Data: "data", Macp: valid.Macp}, 4},
+		{"mac", "POST", pr.SendRequest{Recv: valid.Recv, Data: valid.Data, Macp: pr.NewMAC("other", pack.Body.Hash)}, 6},
+		{"valid", "POST", valid, 0},
+		{"duplicate", "POST", valid, 8},
+	}
+	for _, tt := range tests {
+		var data []byte
+		switch body := tt.body.(type) {
+		case string:
+			data = []byte(body)
+		case nil:
+		default:
+			data, _ = json.Marshal(body)
+		}
+		req, _ := http.NewRequest(tt.method, srv.URL+"/email/send", bytes.NewReader(data))
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res pr.Response
+		json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if res.Return != tt.ret {
+			t.Errorf("%s: return %d != %d (%s)", tt.name, res.Return, tt.ret, res.Result)
+		}
+	}
+	if relay.db.Size(valid.Recv) != 1 {
+		t.Errorf("package is not saved once")
+	}
+	metrics := getTestPage(t, relay, "/metrics")
+	for _, series := range []string{
+		`hes_emails 1`,
+		`hes_send_accepted_total 1`,
+		`hes_send_rejected_total{reason="duplicate"} 1`,
+		`hes_send_rejected_total{reason="mac"} 1`,
+	} {
+		if !strings.Contains(metrics, series+"\n") {
+			t.Errorf("metrics have no '%s'", series)
+		}
+	}
+}
+
+func TestSendLoad(t *testing.T) {
+	_, srv := newTestRelay(t, nil)
+	ctx := context.Background()
+	priv := pr.NewPrivKey("x25519")
+	conn := [2]string{srv.URL, "pasw"}
+	if err := pr.Check(ctx, srv.Client(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.Check(ctx, srv.Client(), [2]string{srv.URL, "other"}); err == nil {
+		t.Fatal("connection with other password is accepted")
+	}
+	heads := []string{"first", "second", "third"}
+	for _, head := range heads {
+		pack, err := pr.NewPackage(priv, priv.PubKey(), pr.NewEmail("sender", head, "body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.Send(ctx, srv.Client(), conn, priv.PubKey(), pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		max   int
+		count int
+	}{
+		{0, 3},
+		{2, 2},
+	}
+	for _, tt := range tests {
+		count := 0
+		err := pr.Load(ctx, srv.Client(), srv.URL, priv, tt.max, func(pack lc.Message) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.count {
+			t.Errorf("max %d: loaded %d != %d", tt.max, count, tt.count)
+		}
+	}
+	other := pr.NewPrivKey("x25519")
+	pr.Load(ctx, srv.Client(), srv.URL, other, 0, func(pack lc.Message) error {
+		t.Errorf("package of other receiver is loaded")
+		return nil
+	})
+}
+
+func TestForward(t *testing.T) {
+	next, nsrv := newTestRelay(t, nil)
+	relay, srv := newTestRelay(t, [][2]string{{nsrv.URL, "pasw"}})
+	priv := pr.NewPrivKey("x25519")
+	pack, err := pr.NewPackage(priv, priv.PubKey(), pr.NewEmail("sender", "head", "body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pr.Send(context.Background(), srv.Client(), [2]string{srv.URL, "pasw"}, priv.PubKey(), pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := priv.PubKey().Address()
+	for i := 0; i < 50 && next.db.Size(recv) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if next.db.Size(recv) != 1 {
+		t.Fatal("package is not forwarded")
+	}
+	for i := 0; i < 50 && !strings.Contains(getTestPage(t, relay, "/metrics"), `result="success"`); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.Contains(getTestPage(t, relay, "/metrics"), `hes_relay_total{peer="`+nsrv.URL+`",result="success"} 1`) {
+		t.Error("forward is not counted")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	relay, _ := newTestRelay(t, nil)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if page := getTestPage(t, relay, path); page != "ok\n" {
+			t.Errorf("%s: '%s'", path, page)
+		}
+	}
+	relay.db.ptr.Close()
+	rec := httptest.NewRecorder()
+	relay.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz with closed database: %d", rec.Code)
+	}
+}
+
+func getTestPage(t *testing.T, relay *Relay, path string) string {
+	rec := httptest.NewRecorder()
+	relay.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	data, _ := ioutil.ReadAll(rec.Body)
+	return string(data)
+}
@@ -11,12 +11,14 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+// Default size of RSA keys,
+// the client allows to select another one.
 const (
 	AKEYSIZE = 2048
 )
 
 var (
-	SETTINGS = gp.NewSettings()
+	SETTINGS = NewSettings()
 	HTCLIENT = new(http.Client)
 	OPENADDR = ""
 )
@@ -41,10 +43,16 @@ func HesDefaultInit(address string) {
 			Timeout:   time.Second * 15,
 		}
 	}
+}
 
-	SETTINGS.Set(gp.SizeWork, 25)
-	SETTINGS.Set(gp.SizePack, 8<<20)
-	SETTINGS.Set(gp.SizeSkey, 1<<5)
+// Nodes and clients must have the same settings,
+// so they are set without the flags.
+func NewSettings() gp.Settings {
+	settings := gp.NewSettings()
+	settings.Set(gp.SizeWork, 25)
+	settings.Set(gp.SizePack, 8<<20)
+	settings.Set(gp.SizeSkey, 1<<5)
+	return settings
 }
 
 func Serialize(data interface{}) []byte {
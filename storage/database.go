@@ -0,0 +1,1742 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+	lc "github.com/number571/go-peer/local"
+	gp "github.com/number571/go-peer/settings"
+
+	pr "github.com/number571/hes/protocol"
+	st "github.com/number571/hes/settings"
+)
+
+const (
+	KEYGRACE  = 72 * time.Hour // old key after rotation
+	DBTIMEOUT = 5000           // ms to wait for the lock of other process
+)
+
+// The database can be opened by the client and hes-cli
+// at the same time, so a locked database is waited for.
+func NewDB(name string) *DB {
+	sep := "?"
+	if strings.Contains(name, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s%s_busy_timeout=%d", name, sep, DBTIMEOUT))
+	if err != nil {
+		return nil
+	}
+	_, err = db.Exec(`
+PRAGMA foreign_keys=ON;
+PRAGMA secure_delete=ON;
+CREATE TABLE IF NOT EXISTS users (
+	id   INTEGER,
+	f2f  BOOLEAN,
+	hashn VARCHAR(255) UNIQUE,
+	hashp VARCHAR(255),
+	salt VARCHAR(255),
+	priv TEXT,
+	oldpriv TEXT,
+	rotated INTEGER DEFAULT 0,
+	kdf  VARCHAR(255) DEFAULT 'raise:25',
+	totp TEXT,
+	recovery TEXT,
+	totpstep INTEGER DEFAULT 0,
+	PRIMARY KEY(id)
+);
+CREATE TABLE IF NOT EXISTS contacts (
+	id      INTEGER,
+	id_user INTEGER,
+	hashn   VARCHAR(255) UNIQUE,
+	hashp   VARCHAR(255) UNIQUE,
+	name    NVARCHAR(255),
+	publ    TEXT,
+	verified BOOLEAN DEFAULT 0,
+	PRIMARY KEY(id),
+	FOREIGN KEY(id_user) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS connects (
+	id      INTEGER,
+	id_user INTEGER,
+	hash    VARCHAR(255) UNIQUE,
+	host    VARCHAR(255),
+	pasw    VARCHAR(255),
+	PRIMARY KEY(id),
+	FOREIGN KEY(id_user) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS emails (
+	id      INTEGER,
+	id_user INTEGER,
+	deleted BOOLEAN DEFAULT 0,
+	hash    VARCHAR(255) UNIQUE,
+	spubl   TEXT,
+	sname   NVARCHAR(255),
+	head    NVARCHAR(255),
+	body    TEXT,
+	addtime TEXT,
+	rpubl   TEXT,
+	phash   TEXT,
+	PRIMARY KEY(id),
+	FOREIGN KEY(id_user) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS identities (
+	id      INTEGER,
+	id_user INTEGER,
+	hash    VARCHAR(255) UNIQUE,
+	name    NVARCHAR(255),
+	publ    TEXT,
+	priv    TEXT,
+	PRIMARY KEY(id),
+	FOREIGN KEY(id_user) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS files (
+	id       INTEGER,
+	id_email INTEGER,
+	name     NVARCHAR(255),
+	data     TEXT,
+	PRIMARY KEY(id),
+	FOREIGN KEY(id_email) REFERENCES emails(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS rotations (
+	id      INTEGER,
+	id_user INTEGER,
+	hash    VARCHAR(255) UNIQUE,
+	oldpubl TEXT,
+	newpubl TEXT,
+	PRIMARY KEY(id),
+	FOREIGN KEY(id_user) REFERENCES users(id) ON DELETE CASCADE
+);
+`)
+	if err != nil {
+		return nil
+	}
+	// columns added after the tables were created,
+	// an error means that the column already exists
+	for _, alter := range []string{
+		"ALTER TABLE contacts ADD COLUMN verified BOOLEAN DEFAULT 0",
+		"ALTER TABLE users ADD COLUMN oldpriv TEXT",
+		"ALTER TABLE users ADD COLUMN rotated INTEGER DEFAULT 0",
+		"ALTER TABLE emails ADD COLUMN rpubl TEXT",
+		"ALTER TABLE users ADD COLUMN kdf VARCHAR(255) DEFAULT 'raise:25'",
+		"ALTER TABLE users ADD COLUMN totp TEXT",
+		"ALTER TABLE users ADD COLUMN recovery TEXT",
+		"ALTER TABLE users ADD COLUMN totpstep INTEGER DEFAULT 0",
+		"ALTER TABLE emails ADD COLUMN phash TEXT",
+	} {
+		db.Exec(alter)
+	}
+	return &DB{
+		ptr: db,
+		kdf: KDFDEFAULT,
+	}
+}
+
+// Parameters of the password hardening for new accounts and
+// changed passwords, old accounts are upgraded at sign-in.
+func (db *DB) SetKDF(kdf string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err := CheckKDF(kdf)
+	if err != nil {
+		return err
+	}
+	db.kdf = kdf
+	return nil
+}
+
+func (db *DB) KDF() string {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.kdf
+}
+
+func (db *DB) StateF2F(user *User) bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		f2f bool
+	)
+	row := db.ptr.QueryRow(
+		"SELECT f2f FROM users WHERE hashn=$1",
+		cr.NewHasher([]byte(user.Name)).String(),
+	)
+	row.Scan(&f2f)
+	return f2f
+}
+
+func (db *DB) SwitchF2F(user *User) error {
+	f2f := !db.StateF2F(user)
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	_, err := db.ptr.Exec(
+		"UPDATE users SET f2f=$1 WHERE hashn=$2",
+		f2f,
+		cr.NewHasher([]byte(user.Name)).String(),
+	)
+	return err
+}
+
+func (db *DB) StateTOTP(user *User) bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		totp sql.NullString
+	)
+	row := db.ptr.QueryRow(
+		"SELECT totp FROM users WHERE id=$1",
+		user.Id,
+	)
+	row.Scan(&totp)
+	return totp.Valid
+}
+
+// Secret and recovery codes are encrypted by the password.
+func (db *DB) SetTOTP(user *User, secret string, codes []string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	cipher := cr.NewCipher(user.pasw)
+	_, err := db.ptr.Exec(
+		"UPDATE users SET totp=$1, recovery=$2, totpstep=0 WHERE id=$3",
+		en.Base64Encode(cipher.Encrypt([]byte(secret))),
+		en.Base64Encode(cipher.Encrypt([]byte(strings.Join(codes, ",")))),
+		user.Id,
+	)
+	return err
+}
+
+func (db *DB) DelTOTP(user *User) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	_, err := db.ptr.Exec(
+		"UPDATE users SET totp=NULL, recovery=NULL, totpstep=0 WHERE id=$1",
+		user.Id,
+	)
+	return err
+}
+
+// The code is a current TOTP code or one of the recovery codes.
+// Recovery codes are removed after use.
+func (db *DB) CheckTOTP(user *User, code string) bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		totp     sql.NullString
+		recovery sql.NullString
+		last     uint64
+	)
+	row := db.ptr.QueryRow(
+		"SELECT totp, recovery, totpstep FROM users WHERE id=$1",
+		user.Id,
+	)
+	row.Scan(&totp, &recovery, &last)
+	if !totp.Valid {
+		return true
+	}
+	cipher := cr.NewCipher(user.pasw)
+	secret := string(cipher.Decrypt(en.Base64Decode(totp.String)))
+	if step := CheckTOTP(secret, code, last); step != 0 {
+		_, err := db.ptr.Exec(
+			"UPDATE users SET totpstep=$1 WHERE id=$2",
+			step,
+			user.Id,
+		)
+		return err == nil
+	}
+	code = strings.ToUpper(strings.TrimSpace(code))
+	codes := strings.Split(string(cipher.Decrypt(en.Base64Decode(recovery.String))), ",")
+	for i := range codes {
+		if code == "" || codes[i] != code {
+			continue
+		}
+		codes = append(codes[:i], codes[i+1:]...)
+		_, err := db.ptr.Exec(
+			"UPDATE users SET recovery=$1 WHERE id=$2",
+			en.Base64Encode(cipher.Encrypt([]byte(strings.Join(codes, ",")))),
+			user.Id,
+		)
+		return err == nil
+	}
+	return false
+}
+
+func (db *DB) SetUser(name, pasw string, priv cr.PrivKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if priv == nil {
+		return fmt.Errorf("private key is null")
+	}
+	name = strings.TrimSpace(name)
+	if len(name) < 6 || len(name) > 64 {
+		return fmt.Errorf("need len username >= 6 and <= 64")
+	}
+	if len(pasw) < 8 {
+		return fmt.Errorf("need len password >= 8")
+	}
+	if db.userExist(name) {
+		return fmt.Errorf("user already exist")
+	}
+	salt := cr.RandBytes(st.SETTINGS.Get(gp.SizeSkey))
+	bpasw, err := DeriveKey(db.kdf, []byte(pasw), salt)
+	if err != nil {
+		return err
+	}
+	hpasw := cr.NewHasher(bytes.Join(
+		[][]byte{
+			bpasw,
+			[]byte(name),
+		},
+		[]byte{},
+	)).Bytes()
+	cipher := cr.NewCipher(bpasw)
+	_, err = db.ptr.Exec(
+		"INSERT INTO users (hashn, hashp, salt, priv, f2f, kdf) VALUES ($1, $2, $3, $4, 0, $5)",
+		cr.NewHasher([]byte(name)).String(),
+		en.Base64Encode(hpasw),
+		en.Base64Encode(salt),
+		en.Base64Encode(cipher.Encrypt(priv.Bytes())),
+		db.kdf,
+	)
+	return err
+}
+
+func (db *DB) GetUser(name, pasw string) *User {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		id       int
+		hpasw    string
+		ssalt    string
+		spriv    string
+		soldpriv sql.NullString
+		rotated  int64
+		kdf      sql.NullString
+	)
+	name = strings.TrimSpace(name)
+	db.delOldKeys()
+	row := db.ptr.QueryRow(
+		"SELECT id, hashp, salt, priv, oldpriv, rotated, kdf FROM users WHERE hashn=$1",
+		cr.NewHasher([]byte(name)).String(),
+	)
+	row.Scan(&id, &hpasw, &ssalt, &spriv, &soldpriv, &rotated, &kdf)
+	if spriv == "" {
+		return nil
+	}
+	if !kdf.Valid {
+		kdf.String = KDFLEGACY
+	}
+	salt := en.Base64Decode(ssalt)
+	bpasw, err := DeriveKey(kdf.String, []byte(pasw), salt)
+	if err != nil {
+		return nil
+	}
+	chpasw := cr.NewHasher(bytes.Join(
+		[][]byte{
+			bpasw,
+			[]byte(name),
+		},
+		[]byte{},
+	)).Bytes()
+	if !bytes.Equal(chpasw, en.Base64Decode(hpasw)) {
+		return nil
+	}
+	cipher := cr.NewCipher(bpasw)
+	priv := pr.LoadPrivKey(cipher.Decrypt(en.Base64Decode(spriv)))
+	if priv == nil {
+		return nil
+	}
+	var oldpriv cr.PrivKey
+	if soldpriv.Valid {
+		oldpriv = pr.LoadPrivKey(cipher.Decrypt(en.Base64Decode(soldpriv.String)))
+	}
+	user := &User{
+		Id:      id,
+		Name:    name,
+		pasw:    bpasw,
+		priv:    priv,
+		oldpriv: oldpriv,
+	}
+	user.identities = db.getIdentities(user)
+	return user
+}
+
+func (db *DB) SetIdentity(user *User, name string, priv cr.PrivKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if priv == nil {
+		return fmt.Errorf("private key is null")
+	}
+	name = strings.TrimSpace(name)
+	if len(name) < 6 || len(name) > 64 {
+		return fmt.Errorf("need len name >= 6 and <= 64")
+	}
+	spub := []byte(priv.PubKey().String())
+	if getIdentityName(user, string(spub)) != "" {
+		return fmt.Errorf("identity already exist")
+	}
+	cipher := cr.NewCipher(user.pasw)
+	_, err := db.ptr.Exec(
+		"INSERT INTO identities (id_user, hash, name, publ, priv) VALUES ($1, $2, $3, $4, $5)",
+		user.Id,
+		hashWithSecret(user, spub),
+		en.Base64Encode(cipher.Encrypt([]byte(name))),
+		en.Base64Encode(cipher.Encrypt(spub)),
+		en.Base64Encode(cipher.Encrypt(priv.Bytes())),
+	)
+	if err != nil {
+		return err
+	}
+	identities := append([]Identity{}, user.identities...)
+	user.setIdentities(append(identities, Identity{Name: name, Priv: priv}))
+	return nil
+}
+
+func (db *DB) DelIdentity(user *User, pub cr.PubKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if pub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	_, err := db.ptr.Exec(
+		"DELETE FROM identities WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hashWithSecret(user, []byte(pub.String())),
+	)
+	if err != nil {
+		return err
+	}
+	// the deleted key is not wiped, it can be used by a task
+	var identities []Identity
+	for _, identity := range user.identities {
+		if identity.Priv.PubKey().String() != pub.String() {
+			identities = append(identities, identity)
+		}
+	}
+	user.setIdentities(identities)
+	return nil
+}
+
+// The old private key is kept to decrypt emails sent
+// before the rotation, so the key is not rotated again
+// until the end of the grace period.
+func (db *DB) RotateKey(user *User, priv cr.PrivKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		rotated int64
+	)
+	if priv == nil {
+		return fmt.Errorf("private key is null")
+	}
+	db.delOldKeys()
+	row := db.ptr.QueryRow(
+		"SELECT rotated FROM users WHERE id=$1 AND oldpriv IS NOT NULL",
+		user.Id,
+	)
+	row.Scan(&rotated)
+	if rotated != 0 {
+		return fmt.Errorf("old key is kept until %s", time.Unix(rotated, 0).Add(KEYGRACE).Format(time.RFC850))
+	}
+	cipher := cr.NewCipher(user.pasw)
+	_, err := db.ptr.Exec(
+		"UPDATE users SET priv=$1, oldpriv=$2, rotated=$3 WHERE id=$4",
+		en.Base64Encode(cipher.Encrypt(priv.Bytes())),
+		en.Base64Encode(cipher.Encrypt(user.priv.Bytes())),
+		time.Now().Unix(),
+		user.Id,
+	)
+	if err != nil {
+		return err
+	}
+	user.mtx.Lock()
+	defer user.mtx.Unlock()
+	user.oldpriv = user.priv
+	user.priv = priv
+	return nil
+}
+
+// Time of the last rotation, zero if the
+// old key is not kept anymore.
+func (db *DB) KeyRotated(user *User) time.Time {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		rotated int64
+	)
+	db.delOldKeys()
+	row := db.ptr.QueryRow(
+		"SELECT rotated FROM users WHERE id=$1 AND oldpriv IS NOT NULL",
+		user.Id,
+	)
+	row.Scan(&rotated)
+	if rotated == 0 {
+		return time.Time{}
+	}
+	return time.Unix(rotated, 0)
+}
+
+// Old keys are deleted at the end of the grace period,
+// keys of open sessions are kept until the sessions end.
+func (db *DB) DelOldKeys() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.delOldKeys()
+}
+
+// The old key of the restored account is kept
+// until the end of the original grace period.
+func (db *DB) SetOldKey(user *User, priv cr.PrivKey, rotated time.Time) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if priv == nil {
+		return fmt.Errorf("private key is null")
+	}
+	if rotated.Add(KEYGRACE).Before(time.Now()) {
+		return fmt.Errorf("grace period is over")
+	}
+	cipher := cr.NewCipher(user.pasw)
+	_, err := db.ptr.Exec(
+		"UPDATE users SET oldpriv=$1, rotated=$2 WHERE id=$3",
+		en.Base64Encode(cipher.Encrypt(priv.Bytes())),
+		rotated.Unix(),
+		user.Id,
+	)
+	if err != nil {
+		return err
+	}
+	user.mtx.Lock()
+	defer user.mtx.Unlock()
+	user.oldpriv = priv
+	return nil
+}
+
+// Accounts with outdated parameters of the password
+// hardening are encrypted again by the same password.
+func (db *DB) UpgradeKDF(user *User, pasw string) error {
+	var kdf sql.NullString
+	db.mtx.Lock()
+	row := db.ptr.QueryRow(
+		"SELECT kdf FROM users WHERE id=$1",
+		user.Id,
+	)
+	row.Scan(&kdf)
+	upgraded := kdf.String == db.kdf
+	db.mtx.Unlock()
+	if upgraded {
+		return nil
+	}
+	return db.ChangePassword(user, pasw)
+}
+
+// All user data is encrypted by the new password in one transaction.
+// Hashes are computed again from the decrypted values.
+func (db *DB) ChangePassword(user *User, pasw string) error {
+	if len(pasw) < 8 {
+		return fmt.Errorf("need len password >= 8")
+	}
+	kdf := db.KDF()
+	salt := cr.RandBytes(st.SETTINGS.Get(gp.SizeSkey))
+	bpasw, err := DeriveKey(kdf, []byte(pasw), salt)
+	if err != nil {
+		return err
+	}
+	hpasw := cr.NewHasher(bytes.Join(
+		[][]byte{
+			bpasw,
+			[]byte(user.Name),
+		},
+		[]byte{},
+	)).Bytes()
+	nuser := &User{
+		Id:   user.Id,
+		Name: user.Name,
+		pasw: bpasw,
+	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	tx, err := db.ptr.Begin()
+	if err != nil {
+		return err
+	}
+	var oldpriv sql.NullString
+	if user.oldpriv != nil {
+		oldpriv.Valid = true
+		oldpriv.String = en.Base64Encode(cr.NewCipher(bpasw).Encrypt(user.oldpriv.Bytes()))
+	}
+	_, err = tx.Exec(
+		"UPDATE users SET hashp=$1, salt=$2, priv=$3, oldpriv=$4, kdf=$5 WHERE id=$6",
+		en.Base64Encode(hpasw),
+		en.Base64Encode(salt),
+		en.Base64Encode(cr.NewCipher(bpasw).Encrypt(user.priv.Bytes())),
+		oldpriv,
+		kdf,
+		user.Id,
+	)
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "contacts", "id_user=$1",
+			[]string{"name", "publ"}, [][2]string{{"hashn", "name"}, {"hashp", "publ"}})
+	}
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "connects", "id_user=$1",
+			[]string{"host", "pasw"}, [][2]string{{"hash", "host"}})
+	}
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "emails", "id_user=$1",
+			[]string{"spubl", "sname", "head", "body", "addtime", "rpubl", "phash"}, [][2]string{{"hash", "phash"}})
+	}
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "identities", "id_user=$1",
+			[]string{"name", "publ", "priv"}, [][2]string{{"hash", "publ"}})
+	}
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "users", "id=$1",
+			[]string{"totp", "recovery"}, nil)
+	}
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "files", "id_email IN (SELECT id FROM emails WHERE id_user=$1)",
+			[]string{"name", "data"}, nil)
+	}
+	if err == nil {
+		err = recryptRows(tx, user, nuser, "rotations", "id_user=$1",
+			[]string{"oldpubl", "newpubl"}, [][2]string{{"hash", "oldpubl"}})
+	}
+	if err == nil {
+		err = rehashEmails(tx, user, nuser)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// the old key is used only by the database under the lock
+	user.mtx.Lock()
+	defer user.mtx.Unlock()
+	wipeBytes(user.pasw)
+	user.pasw = bpasw
+	return nil
+}
+
+// Key material is overwritten under the locks of the database
+// and of the user, so no method uses the keys while they are wiped.
+// RSA keys can not be zeroized: go-peer keeps them in an unexported
+// field, so they stay in memory until it is reused.
+func (db *DB) WipeUser(user *User) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	user.mtx.Lock()
+	defer user.mtx.Unlock()
+	wipeBytes(user.pasw)
+	user.pasw = nil
+	keys := []cr.PrivKey{user.priv, user.oldpriv}
+	for _, identity := range user.identities {
+		keys = append(keys, identity.Priv)
+	}
+	for _, priv := range keys {
+		if x, ok := priv.(*pr.PrivKeyX25519); ok {
+			x.Wipe()
+		}
+	}
+}
+
+func (db *DB) DelUser(user *User) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	_, err := db.ptr.Exec(
+		"DELETE FROM users WHERE id=$1",
+		user.Id,
+	)
+	return err
+}
+
+func (db *DB) GetEmails(user *User, start, quan int) []Email {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		spubl  string
+		sname  string
+		head   string
+		hash   string
+		atime  string
+		rpubl  sql.NullString
+		emails []Email
+	)
+	rows, err := db.ptr.Query(
+		"SELECT spubl, sname, head, hash, addtime, rpubl FROM emails WHERE id_user=$1 AND deleted=0 ORDER BY id DESC LIMIT $2 OFFSET $3",
+		user.Id,
+		quan,
+		start,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for id := start; rows.Next(); id++ {
+		err = rows.Scan(
+			&spubl,
+			&sname,
+			&head,
+			&hash,
+			&atime,
+			&rpubl,
+		)
+		if err != nil {
+			break
+		}
+		// emails saved before the files table keep
+		// the names of attachments in the head
+		head = string(cipher.Decrypt(en.Base64Decode(head)))
+		spubl = string(cipher.Decrypt(en.Base64Decode(spubl)))
+		srecv := string(cipher.Decrypt(en.Base64Decode(rpubl.String)))
+		emails = append(emails, Email{
+			Id:         id,
+			Hash:       hash,
+			SenderPubl: spubl,
+			SenderName: string(cipher.Decrypt(en.Base64Decode(sname))),
+			Head:       strings.Split(head, pr.FSEPARAT)[0],
+			Time:       string(cipher.Decrypt(en.Base64Decode(atime))),
+			Contact:    db.getContactName(user, spubl),
+			RecvPubl:   srecv,
+			Identity:   getIdentityName(user, srecv),
+		})
+	}
+	return emails
+}
+
+func (db *DB) GetEmail(user *User, id int) *Email {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		rowid int
+	)
+	row := db.ptr.QueryRow(
+		"SELECT id FROM emails WHERE id_user=$1 AND deleted=0 ORDER BY id DESC LIMIT 1 OFFSET $2",
+		user.Id,
+		id,
+	)
+	row.Scan(&rowid)
+	email := db.getEmail(user, rowid)
+	if email == nil {
+		return nil
+	}
+	email.Id = id
+	return email
+}
+
+func (db *DB) GetEmailByHash(user *User, hash string) *Email {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		rowid int
+	)
+	row := db.ptr.QueryRow(
+		"SELECT id FROM emails WHERE id_user=$1 AND hash=$2 AND deleted=0",
+		user.Id,
+		hash,
+	)
+	row.Scan(&rowid)
+	return db.getEmail(user, rowid)
+}
+
+// Email saved from the package by SetEmail.
+func (db *DB) GetEmailByPack(user *User, pack lc.Message) *Email {
+	return db.GetEmailByHash(user, hashWithSecret(user, pack.Body.Hash))
+}
+
+// All emails of the user from the oldest to the newest.
+func (db *DB) GetMailbox(user *User) []Email {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		rowid  int
+		rowids []int
+		emails []Email
+	)
+	rows, err := db.ptr.Query(
+		"SELECT id FROM emails WHERE id_user=$1 AND deleted=0 ORDER BY id",
+		user.Id,
+	)
+	if err != nil {
+		return nil
+	}
+	for rows.Next() {
+		err = rows.Scan(&rowid)
+		if err != nil {
+			break
+		}
+		rowids = append(rowids, rowid)
+	}
+	rows.Close()
+	for i, rowid := range rowids {
+		email := db.getEmail(user, rowid)
+		if email == nil {
+			continue
+		}
+		email.Id = len(rowids) - i - 1
+		emails = append(emails, *email)
+	}
+	return emails
+}
+
+func (db *DB) SetEmail(user *User, recv cr.PubKey, pack lc.Message) error {
+	pub := pr.LoadPubKey(pack.Head.Sender)
+	if db.StateF2F(user) && !db.InContacts(user, pub) {
+		return fmt.Errorf("sender not in contacts")
+	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	title, data := pack.Export()
+	if !bytes.Equal(title, []byte(pr.IS_EMAIL)) {
+		return fmt.Errorf("is not email")
+	}
+	if db.emailExist(user, pack.Body.Hash) {
+		return fmt.Errorf("email already exist")
+	}
+	var email pr.Email
+	err := json.Unmarshal([]byte(data), &email)
+	if err != nil {
+		return fmt.Errorf("json decode")
+	}
+	name := strings.TrimSpace(email.SenderName)
+	if len(name) < 6 || len(name) > 64 {
+		return fmt.Errorf("len username < 6 or > 64")
+	}
+	head := strings.TrimSpace(email.Head)
+	body := strings.TrimSpace(email.Body)
+	if head == "" || body == "" {
+		return fmt.Errorf("head or body is null")
+	}
+	heads := strings.Split(head, pr.FSEPARAT)
+	bodys := strings.Split(body, pr.FSEPARAT)
+	if len(heads) != len(bodys) {
+		return fmt.Errorf("len.head != len.body")
+	}
+	var files [][2]string
+	for i := 1; i < len(heads); i++ {
+		files = append(files, [2]string{
+			heads[i],
+			bodys[i],
+		})
+	}
+	return db.setEmail(user, hashWithSecret(user, pack.Body.Hash), pack.Body.Hash, &Email{
+		SenderPubl: pub.String(),
+		SenderName: name,
+		Head:       heads[0],
+		Body:       bodys[0],
+		Time:       time.Now().Format(time.RFC850),
+		Files:      files,
+		RecvPubl:   recv.String(),
+	})
+}
+
+// The hash of the restored email is built from the package hash.
+// Backups made before the package hash was saved have only the
+// hash of the old account, so the hash is built from it.
+func (db *DB) RestoreEmail(user *User, email *Email) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if pr.LoadPubKeyByString(email.SenderPubl) == nil {
+		return fmt.Errorf("public key is null")
+	}
+	if email.Head == "" || email.Body == "" {
+		return fmt.Errorf("head or body is null")
+	}
+	if email.Pack == "" {
+		return db.setEmail(user, hashWithSecret(user, []byte(email.Hash)), nil, email)
+	}
+	pack := en.Base64Decode(email.Pack)
+	if pack == nil {
+		return fmt.Errorf("package hash is not valid")
+	}
+	return db.setEmail(user, hashWithSecret(user, pack), pack, email)
+}
+
+// Package hashes of the deleted emails, they are kept
+// so that the emails are not loaded from nodes again.
+// Emails deleted before the package hash was saved are skipped.
+func (db *DB) GetDeleted(user *User) []string {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		phash  string
+		hashes []string
+	)
+	rows, err := db.ptr.Query(
+		"SELECT phash FROM emails WHERE id_user=$1 AND deleted=1 AND phash IS NOT NULL ORDER BY id",
+		user.Id,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for rows.Next() {
+		err = rows.Scan(&phash)
+		if err != nil {
+			break
+		}
+		hashes = append(hashes, en.Base64Encode(cipher.Decrypt(en.Base64Decode(phash))))
+	}
+	return hashes
+}
+
+// Deleted email is restored by the package hash only.
+func (db *DB) RestoreDeleted(user *User, spack string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	pack := en.Base64Decode(spack)
+	if pack == nil {
+		return fmt.Errorf("package hash is not valid")
+	}
+	if db.emailExist(user, pack) {
+		return fmt.Errorf("email already exist")
+	}
+	cipher := cr.NewCipher(user.pasw)
+	_, err := db.ptr.Exec(
+		"INSERT INTO emails (id_user, deleted, hash, phash) VALUES ($1, 1, $2, $3)",
+		user.Id,
+		hashWithSecret(user, pack),
+		en.Base64Encode(cipher.Encrypt(pack)),
+	)
+	return err
+}
+
+func (db *DB) DelEmail(user *User, hash string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	tx, err := db.ptr.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"DELETE FROM files WHERE id_email IN (SELECT id FROM emails WHERE id_user=$1 AND hash=$2)",
+		user.Id,
+		hash,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE emails SET deleted=1, spubl=NULL, sname=NULL, head=NULL, body=NULL, addtime=NULL WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hash,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sign = sign[new_private_key](hash(old_public_key || new_public_key))
+func (db *DB) SetRotation(user *User, pack lc.Message) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	title, data := pack.Export()
+	if !bytes.Equal(title, []byte(pr.IS_ROTATE)) {
+		return fmt.Errorf("is not rotation")
+	}
+	oldpub := pr.LoadPubKey(pack.Head.Sender)
+	if oldpub == nil || db.getContactName(user, oldpub.String()) == "" {
+		return fmt.Errorf("sender not in contacts")
+	}
+	var rotation pr.Rotation
+	err := json.Unmarshal([]byte(data), &rotation)
+	if err != nil {
+		return fmt.Errorf("json decode")
+	}
+	newpub := pr.LoadPubKeyByString(rotation.NewPubl)
+	if newpub == nil {
+		return fmt.Errorf("public key is not valid")
+	}
+	hash := cr.NewHasher(bytes.Join(
+		[][]byte{
+			oldpub.Bytes(),
+			newpub.Bytes(),
+		},
+		[]byte{},
+	)).Bytes()
+	if !newpub.Verify(hash, en.Base64Decode(rotation.Sign)) {
+		return fmt.Errorf("sign is not valid")
+	}
+	cipher := cr.NewCipher(user.pasw)
+	_, err = db.ptr.Exec(
+		"INSERT OR REPLACE INTO rotations (id_user, hash, oldpubl, newpubl) VALUES ($1, $2, $3, $4)",
+		user.Id,
+		hashWithSecret(user, []byte(oldpub.String())),
+		en.Base64Encode(cipher.Encrypt([]byte(oldpub.String()))),
+		en.Base64Encode(cipher.Encrypt([]byte(newpub.String()))),
+	)
+	return err
+}
+
+func (db *DB) GetRotations(user *User) []Rotation {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		oldpubl   string
+		newpubl   string
+		rotations []Rotation
+	)
+	rows, err := db.ptr.Query(
+		"SELECT oldpubl, newpubl FROM rotations WHERE id_user=$1",
+		user.Id,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for rows.Next() {
+		err = rows.Scan(
+			&oldpubl,
+			&newpubl,
+		)
+		if err != nil {
+			break
+		}
+		rotations = append(rotations, Rotation{
+			OldPubl: string(cipher.Decrypt(en.Base64Decode(oldpubl))),
+			NewPubl: string(cipher.Decrypt(en.Base64Decode(newpubl))),
+		})
+	}
+	rows.Close()
+	for i := range rotations {
+		rotations[i].Name = db.getContactName(user, rotations[i].OldPubl)
+	}
+	return rotations
+}
+
+// The key of the contact is replaced by the announced one,
+// the new key is not verified.
+func (db *DB) AcceptRotation(user *User, oldpub cr.PubKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		newpubl string
+	)
+	if oldpub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	row := db.ptr.QueryRow(
+		"SELECT newpubl FROM rotations WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hashWithSecret(user, []byte(oldpub.String())),
+	)
+	row.Scan(&newpubl)
+	if newpubl == "" {
+		return fmt.Errorf("rotation undefined")
+	}
+	cipher := cr.NewCipher(user.pasw)
+	newpub := pr.LoadPubKeyByString(string(cipher.Decrypt(en.Base64Decode(newpubl))))
+	if newpub == nil {
+		return fmt.Errorf("public key is not valid")
+	}
+	if db.contactPublExist(user, newpub) {
+		return fmt.Errorf("contact already exist")
+	}
+	_, err := db.ptr.Exec(
+		"UPDATE contacts SET hashp=$1, publ=$2, verified=0 WHERE id_user=$3 AND hashp=$4",
+		hashWithSecret(user, []byte(newpub.String())),
+		en.Base64Encode(cipher.Encrypt([]byte(newpub.String()))),
+		user.Id,
+		hashWithSecret(user, []byte(oldpub.String())),
+	)
+	if err != nil {
+		return err
+	}
+	return db.delRotation(user, oldpub)
+}
+
+func (db *DB) DelRotation(user *User, oldpub cr.PubKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if oldpub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	return db.delRotation(user, oldpub)
+}
+
+func (db *DB) GetContacts(user *User) []Contact {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		name     string
+		spub     string
+		verified bool
+		contacts []Contact
+	)
+	rows, err := db.ptr.Query(
+		"SELECT name, publ, verified FROM contacts WHERE id_user=$1",
+		user.Id,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for rows.Next() {
+		err = rows.Scan(
+			&name,
+			&spub,
+			&verified,
+		)
+		if err != nil {
+			break
+		}
+		contacts = append(contacts, Contact{
+			Name:     string(cipher.Decrypt(en.Base64Decode(name))),
+			Publ:     string(cipher.Decrypt(en.Base64Decode(spub))),
+			Verified: verified,
+		})
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Name < contacts[j].Name
+	})
+	return contacts
+}
+
+func (db *DB) IsVerified(user *User, pub cr.PubKey) bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		verified bool
+	)
+	if pub == nil {
+		return false
+	}
+	row := db.ptr.QueryRow(
+		"SELECT verified FROM contacts WHERE id_user=$1 AND hashp=$2",
+		user.Id,
+		hashWithSecret(user, []byte(pub.String())),
+	)
+	row.Scan(&verified)
+	return verified
+}
+
+func (db *DB) SwitchVerified(user *User, pub cr.PubKey) error {
+	verified := !db.IsVerified(user, pub)
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if pub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	_, err := db.ptr.Exec(
+		"UPDATE contacts SET verified=$1 WHERE id_user=$2 AND hashp=$3",
+		verified,
+		user.Id,
+		hashWithSecret(user, []byte(pub.String())),
+	)
+	return err
+}
+
+func (db *DB) InContacts(user *User, pub cr.PubKey) bool {
+	return db.GetContactName(user, pub) != ""
+}
+
+func (db *DB) GetContactName(user *User, pub cr.PubKey) string {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if pub == nil {
+		return ""
+	}
+	return db.getContactName(user, pub.String())
+}
+
+func (db *DB) SetContact(user *User, name string, pub cr.PubKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if pub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return fmt.Errorf("nickname is null")
+	}
+	if db.contactExist(user, name, pub) {
+		return fmt.Errorf("contact already exist")
+	}
+	return setContact(db.ptr, user, name, pub, false)
+}
+
+// Contacts with the same name or the same public key are
+// conflicts, they are deleted only if replace is set.
+// The same contact gets the verified flag of the imported one.
+func (db *DB) ImportContact(user *User, contact Contact, replace bool) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	pub := pr.LoadPubKeyByString(contact.Publ)
+	if pub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	name := strings.TrimSpace(contact.Name)
+	if len(name) == 0 {
+		return fmt.Errorf("nickname is null")
+	}
+	namex := db.contactNameExist(user, name)
+	publx := db.contactPublExist(user, pub)
+	if namex && publx && db.getContactName(user, pub.String()) == name {
+		if !replace {
+			return fmt.Errorf("contact already exist")
+		}
+		_, err := db.ptr.Exec(
+			"UPDATE contacts SET verified=$1 WHERE id_user=$2 AND hashp=$3",
+			contact.Verified,
+			user.Id,
+			hashWithSecret(user, []byte(pub.String())),
+		)
+		return err
+	}
+	if !replace && publx {
+		return fmt.Errorf("duplicate public key")
+	}
+	if !replace && namex {
+		return fmt.Errorf("duplicate nickname")
+	}
+	tx, err := db.ptr.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"DELETE FROM contacts WHERE id_user=$1 AND (hashn=$2 OR hashp=$3)",
+		user.Id,
+		hashWithSecret(user, []byte(name)),
+		hashWithSecret(user, []byte(pub.String())),
+	)
+	if err == nil {
+		err = setContact(tx, user, name, pub, contact.Verified)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) DelContact(user *User, pub cr.PubKey) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if pub == nil {
+		return fmt.Errorf("public key is null")
+	}
+	spub := []byte(pub.String())
+	_, err := db.ptr.Exec(
+		"DELETE FROM contacts WHERE id_user=$1 AND hashp=$2",
+		user.Id,
+		hashWithSecret(user, spub),
+	)
+	return err
+}
+
+func (db *DB) GetConns(user *User) [][2]string {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var (
+		conn     string
+		pasw     string
+		connects [][2]string
+	)
+	rows, err := db.ptr.Query(
+		"SELECT host, pasw FROM connects WHERE id_user=$1",
+		user.Id,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for rows.Next() {
+		err = rows.Scan(
+			&conn,
+			&pasw,
+		)
+		if err != nil {
+			break
+		}
+		connects = append(connects, [2]string{
+			string(cipher.Decrypt(en.Base64Decode(conn))),
+			string(cipher.Decrypt(en.Base64Decode(pasw))),
+		})
+	}
+	return connects
+}
+
+func (db *DB) SetConn(user *User, host, pasw string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	host = strings.TrimSpace(host)
+	if len(host) == 0 {
+		return fmt.Errorf("host is null")
+	}
+	cipher := cr.NewCipher(user.pasw)
+	if db.connExist(user, host) {
+		_, err := db.ptr.Exec(
+			"UPDATE connects SET pasw=$1 WHERE id_user=$2 AND hash=$3",
+			en.Base64Encode(cipher.Encrypt([]byte(pasw))),
+			user.Id,
+			hashWithSecret(user, []byte(host)),
+		)
+		return err
+	}
+	_, err := db.ptr.Exec(
+		"INSERT INTO connects (id_user, hash, host, pasw) VALUES ($1, $2, $3, $4)",
+		user.Id,
+		hashWithSecret(user, []byte(host)),
+		en.Base64Encode(cipher.Encrypt([]byte(host))),
+		en.Base64Encode(cipher.Encrypt([]byte(pasw))),
+	)
+	return err
+}
+
+func (db *DB) DelConn(user *User, host string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	host = strings.TrimSpace(host)
+	if len(host) == 0 {
+		return fmt.Errorf("host is null")
+	}
+	_, err := db.ptr.Exec(
+		"DELETE FROM connects WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hashWithSecret(user, []byte(host)),
+	)
+	return err
+}
+
+func (db *DB) getEmail(user *User, rowid int) *Email {
+	var (
+		spubl string
+		sname string
+		head  string
+		body  string
+		hash  string
+		atime string
+		rpubl sql.NullString
+		phash sql.NullString
+	)
+	row := db.ptr.QueryRow(
+		"SELECT spubl, sname, head, body, hash, addtime, rpubl, phash FROM emails WHERE id_user=$1 AND id=$2 AND deleted=0",
+		user.Id,
+		rowid,
+	)
+	row.Scan(&spubl, &sname, &head, &body, &hash, &atime, &rpubl, &phash)
+	if spubl == "" {
+		return nil
+	}
+	cipher := cr.NewCipher(user.pasw)
+	spubl = string(cipher.Decrypt(en.Base64Decode(spubl)))
+	srecv := string(cipher.Decrypt(en.Base64Decode(rpubl.String)))
+	email := &Email{
+		Hash:       hash,
+		SenderPubl: spubl,
+		SenderName: string(cipher.Decrypt(en.Base64Decode(sname))),
+		Head:       string(cipher.Decrypt(en.Base64Decode(head))),
+		Body:       string(cipher.Decrypt(en.Base64Decode(body))),
+		Time:       string(cipher.Decrypt(en.Base64Decode(atime))),
+		Files:      db.getFiles(user, rowid),
+		Contact:    db.getContactName(user, spubl),
+		RecvPubl:   srecv,
+		Identity:   getIdentityName(user, srecv),
+	}
+	if phash.Valid {
+		email.Pack = en.Base64Encode(cipher.Decrypt(en.Base64Decode(phash.String)))
+	}
+	// emails saved before the files table keep
+	// attachments in the head and body
+	heads := strings.Split(email.Head, pr.FSEPARAT)
+	bodys := strings.Split(email.Body, pr.FSEPARAT)
+	if len(heads) > 1 && len(heads) == len(bodys) {
+		email.Head, email.Body = heads[0], bodys[0]
+		for i := 1; i < len(heads); i++ {
+			email.Files = append(email.Files, [2]string{
+				heads[i],
+				bodys[i],
+			})
+		}
+	}
+	return email
+}
+
+// The package hash is kept encrypted to compute
+// the hash again after the password change.
+func (db *DB) setEmail(user *User, hash string, pack []byte, email *Email) error {
+	cipher := cr.NewCipher(user.pasw)
+	var phash sql.NullString
+	if pack != nil {
+		phash.Valid = true
+		phash.String = en.Base64Encode(cipher.Encrypt(pack))
+	}
+	tx, err := db.ptr.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		"INSERT INTO emails (id_user, hash, spubl, sname, head, body, addtime, rpubl, phash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		user.Id,
+		hash,
+		en.Base64Encode(cipher.Encrypt([]byte(email.SenderPubl))),
+		en.Base64Encode(cipher.Encrypt([]byte(email.SenderName))),
+		en.Base64Encode(cipher.Encrypt([]byte(email.Head))),
+		en.Base64Encode(cipher.Encrypt([]byte(email.Body))),
+		en.Base64Encode(cipher.Encrypt([]byte(email.Time))),
+		en.Base64Encode(cipher.Encrypt([]byte(email.RecvPubl))),
+		phash,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rowid, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, file := range email.Files {
+		_, err = tx.Exec(
+			"INSERT INTO files (id_email, name, data) VALUES ($1, $2, $3)",
+			rowid,
+			en.Base64Encode(cipher.Encrypt([]byte(file[0]))),
+			en.Base64Encode(cipher.Encrypt([]byte(file[1]))),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) getIdentities(user *User) []Identity {
+	var (
+		name       string
+		spriv      string
+		identities []Identity
+	)
+	rows, err := db.ptr.Query(
+		"SELECT name, priv FROM identities WHERE id_user=$1 ORDER BY id",
+		user.Id,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for rows.Next() {
+		err = rows.Scan(
+			&name,
+			&spriv,
+		)
+		if err != nil {
+			break
+		}
+		priv := pr.LoadPrivKey(cipher.Decrypt(en.Base64Decode(spriv)))
+		if priv == nil {
+			continue
+		}
+		identities = append(identities, Identity{
+			Name: string(cipher.Decrypt(en.Base64Decode(name))),
+			Priv: priv,
+		})
+	}
+	return identities
+}
+
+func (db *DB) getFiles(user *User, id int) [][2]string {
+	var (
+		name  string
+		data  string
+		files [][2]string
+	)
+	rows, err := db.ptr.Query(
+		"SELECT name, data FROM files WHERE id_email=$1 ORDER BY id",
+		id,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cipher := cr.NewCipher(user.pasw)
+	for rows.Next() {
+		err = rows.Scan(
+			&name,
+			&data,
+		)
+		if err != nil {
+			break
+		}
+		files = append(files, [2]string{
+			string(cipher.Decrypt(en.Base64Decode(name))),
+			string(cipher.Decrypt(en.Base64Decode(data))),
+		})
+	}
+	return files
+}
+
+func (db *DB) delOldKeys() error {
+	_, err := db.ptr.Exec(
+		"UPDATE users SET oldpriv=NULL WHERE oldpriv IS NOT NULL AND rotated<$1",
+		time.Now().Add(-KEYGRACE).Unix(),
+	)
+	return err
+}
+
+func (db *DB) delRotation(user *User, oldpub cr.PubKey) error {
+	_, err := db.ptr.Exec(
+		"DELETE FROM rotations WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hashWithSecret(user, []byte(oldpub.String())),
+	)
+	return err
+}
+
+func (db *DB) getContactName(user *User, spub string) string {
+	var (
+		name string
+	)
+	row := db.ptr.QueryRow(
+		"SELECT name FROM contacts WHERE id_user=$1 AND hashp=$2",
+		user.Id,
+		hashWithSecret(user, []byte(spub)),
+	)
+	row.Scan(&name)
+	if name == "" {
+		return ""
+	}
+	cipher := cr.NewCipher(user.pasw)
+	return string(cipher.Decrypt(en.Base64Decode(name)))
+}
+
+func (db *DB) userExist(name string) bool {
+	var (
+		namee string
+	)
+	row := db.ptr.QueryRow(
+		"SELECT name FROM users WHERE hashn=$1",
+		cr.NewHasher([]byte(name)).String(),
+	)
+	row.Scan(&namee)
+	return namee != ""
+}
+
+// Statements are executed by the database or by a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func setContact(ex execer, user *User, name string, pub cr.PubKey, verified bool) error {
+	cipher := cr.NewCipher(user.pasw)
+	spub := []byte(pub.String())
+	_, err := ex.Exec(
+		"INSERT INTO contacts (id_user, hashn, hashp, name, publ, verified) VALUES ($1, $2, $3, $4, $5, $6)",
+		user.Id,
+		hashWithSecret(user, []byte(name)),
+		hashWithSecret(user, spub),
+		en.Base64Encode(cipher.Encrypt([]byte(name))),
+		en.Base64Encode(cipher.Encrypt(spub)),
+		verified,
+	)
+	return err
+}
+
+func (db *DB) contactExist(user *User, name string, pub cr.PubKey) bool {
+	return db.contactNameExist(user, name) || db.contactPublExist(user, pub)
+}
+
+func (db *DB) contactNameExist(user *User, name string) bool {
+	var (
+		namee string
+	)
+	row := db.ptr.QueryRow(
+		"SELECT name FROM contacts WHERE id_user=$1 AND hashn=$2",
+		user.Id,
+		hashWithSecret(user, []byte(name)),
+	)
+	row.Scan(&namee)
+	return namee != ""
+}
+
+func (db *DB) contactPublExist(user *User, pub cr.PubKey) bool {
+	var (
+		namee string
+	)
+	row := db.ptr.QueryRow(
+		"SELECT name FROM contacts WHERE id_user=$1 AND hashp=$2",
+		user.Id,
+		hashWithSecret(user, []byte(pub.String())),
+	)
+	row.Scan(&namee)
+	return namee != ""
+}
+
+func (db *DB) connExist(user *User, host string) bool {
+	var (
+		hoste string
+	)
+	row := db.ptr.QueryRow(
+		"SELECT host FROM connects WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hashWithSecret(user, []byte(host)),
+	)
+	row.Scan(&hoste)
+	return hoste != ""
+}
+
+func (db *DB) emailExist(user *User, pack []byte) bool {
+	var (
+		hashe string
+	)
+	row := db.ptr.QueryRow(
+		"SELECT hash FROM emails WHERE id_user=$1 AND hash=$2",
+		user.Id,
+		hashWithSecret(user, pack),
+	)
+	row.Scan(&hashe)
+	return hashe != ""
+}
+
+// Columns are decrypted by the key of the old user and encrypted by
+// the key of the new user, hash columns are computed from the
+// decrypted values. NULL values of the deleted emails stay NULL.
+func recryptRows(tx *sql.Tx, ouser, nuser *User, table, where string, columns []string, hashes [][2]string) error {
+	type record struct {
+		id     int
+		values []sql.NullString
+	}
+	var (
+		records []record
+	)
+	rows, err := tx.Query(
+		fmt.Sprintf("SELECT id, %s FROM %s WHERE %s", strings.Join(columns, ", "), table, where),
+		ouser.Id,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		rec := record{values: make([]sql.NullString, len(columns))}
+		dest := []interface{}{&rec.id}
+		for i := range rec.values {
+			dest = append(dest, &rec.values[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, rec)
+	}
+	rows.Close()
+	ocipher := cr.NewCipher(ouser.pasw)
+	ncipher := cr.NewCipher(nuser.pasw)
+	for _, rec := range records {
+		var (
+			sets  []string
+			args  []interface{}
+			plain = make(map[string][]byte)
+		)
+		for i, col := range columns {
+			args = append(args, rec.values[i])
+			sets = append(sets, fmt.Sprintf("%s=$%d", col, len(args)))
+			if !rec.values[i].Valid {
+				continue
+			}
+			data := ocipher.Decrypt(en.Base64Decode(rec.values[i].String))
+			plain[col] = data
+			args[len(args)-1] = en.Base64Encode(ncipher.Encrypt(data))
+		}
+		for _, hash := range hashes {
+			data, ok := plain[hash[1]]
+			if !ok {
+				continue
+			}
+			args = append(args, hashWithSecret(nuser, data))
+			sets = append(sets, fmt.Sprintf("%s=$%d", hash[0], len(args)))
+		}
+		args = append(args, rec.id)
+		_, err = tx.Exec(
+			fmt.Sprintf("UPDATE %s SET %s WHERE id=$%d", table, strings.Join(sets, ", "), len(args)),
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Emails saved before the phash column have no package
+// hash, so their hashes are built from the old ones.
+func rehashEmails(tx *sql.Tx, ouser, nuser *User) error {
+	var (
+		id     int
+		hash   string
+		hashes = make(map[int]string)
+	)
+	rows, err := tx.Query(
+		"SELECT id, hash FROM emails WHERE id_user=$1 AND phash IS NULL",
+		ouser.Id,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		err = rows.Scan(&id, &hash)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = hash
+	}
+	rows.Close()
+	for id, hash := range hashes {
+		_, err = tx.Exec(
+			"UPDATE emails SET hash=$1 WHERE id=$2",
+			hashWithSecret(nuser, []byte(hash)),
+			id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The main and the old keys belong to the account name.
+func getIdentityName(user *User, spub string) string {
+	if spub == "" {
+		return ""
+	}
+	for _, priv := range []cr.PrivKey{user.priv, user.oldpriv} {
+		if priv != nil && priv.PubKey().String() == spub {
+			return user.Name
+		}
+	}
+	for _, identity := range user.identities {
+		if identity.Priv.PubKey().String() == spub {
+			return identity.Name
+		}
+	}
+	return ""
+}
+
+func wipeBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+func hashWithSecret(user *User, data []byte) string {
+	return cr.NewHasherMAC(data, user.pasw).String()
+}
@@ -0,0 +1,259 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	lc "github.com/number571/go-peer/local"
+
+	"github.com/number571/hes/internal/hestest"
+	pr "github.com/number571/hes/protocol"
+	sr "github.com/number571/hes/storage"
+)
+
+func TestMain(m *testing.M) {
+	hestest.Main(m)
+}
+
+func newTestDB(t *testing.T) *sr.DB {
+	db := sr.NewDB(filepath.Join(t.TempDir(), "hes.db"))
+	if db == nil {
+		t.Fatal("database is null")
+	}
+	if err := db.SetKDF(hestest.KDF); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestChangePassword(t *testing.T) {
+	db := newTestDB(t)
+	user := hestest.NewUser(t, db, "username", "password1", pr.NewPrivKey("x25519"))
+	friend := pr.NewPrivKey("x25519")
+	secret := sr.NewTOTPSecret()
+	if err := db.SetContact(user, "friend", friend.PubKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetConn(user, "http://localhost:8080", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetIdentity(user, "identity", pr.NewPrivKey("x25519")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTOTP(user, secret, []string{"CODE"}); err != nil {
+		t.Fatal(err)
+	}
+	kept := hestest.NewEmail(friend, user.Priv(), "head"+pr.FSEPARAT+"file.txt", "body"+pr.FSEPARAT+"ZGF0YQ==")
+	deleted := hestest.NewEmail(friend, user.Priv(), "head", "body")
+	for _, pack := range []lc.Message{kept, deleted} {
+		if err := db.SetEmail(user, user.Priv().PubKey(), pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DelEmail(user, db.GetEmailByPack(user, deleted).Hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ChangePassword(user, "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if db.GetUser("username", "password1") != nil {
+		t.Fatal("old password is accepted")
+	}
+	user = db.GetUser("username", "password2")
+	if user == nil {
+		t.Fatal("new password is not accepted")
+	}
+
+	if !db.InContacts(user, friend.PubKey()) || db.GetContactName(user, friend.PubKey()) != "friend" {
+		t.Error("contact is not found by the key")
+	}
+	if conns := db.GetConns(user); len(conns) != 1 || conns[0] != [2]string{"http://localhost:8080", "secret"} {
+		t.Errorf("connections %v", conns)
+	}
+	if len(user.Identities()) != 1 || user.Identities()[0].Name != "identity" {
+		t.Error("identity is not decrypted")
+	}
+	if !db.CheckTOTP(user, sr.GetTOTP(secret)) {
+		t.Error("TOTP secret is not decrypted")
+	}
+	email := db.GetEmailByPack(user, kept)
+	if email == nil {
+		t.Fatal("email is not found by the package")
+	}
+	if email.Head != "head" || len(email.Files) != 1 {
+		t.Errorf("email is not decrypted: '%s', %d files", email.Head, len(email.Files))
+	}
+	if db.SetEmail(user, user.Priv().PubKey(), kept) == nil {
+		t.Error("email is saved again")
+	}
+	if db.SetEmail(user, user.Priv().PubKey(), deleted) == nil {
+		t.Error("deleted email is saved again")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	db := newTestDB(t)
+	user := hestest.NewUser(t, db, "username", "password1", pr.NewPrivKey("x25519"))
+	oldpriv := user.Priv()
+	if err := db.RotateKey(user, pr.RenewPrivKey(oldpriv)); err != nil {
+		t.Fatal(err)
+	}
+	if db.RotateKey(user, pr.RenewPrivKey(oldpriv)) == nil {
+		t.Fatal("key is rotated during the grace period")
+	}
+	loaded := db.GetUser("username", "password1")
+	if loaded.OldPriv() == nil || loaded.OldPriv().String() != oldpriv.String() {
+		t.Fatal("old key is not kept")
+	}
+	if db.KeyRotated(user).IsZero() {
+		t.Error("time of the rotation is not kept")
+	}
+
+	db.SetRotated(user, time.Now().Add(-sr.KEYGRACE-time.Minute))
+	if err := db.DelOldKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if db.OldKeyStored(user) {
+		t.Error("old key is stored after the grace period")
+	}
+	if db.GetUser("username", "password1").OldPriv() != nil || !db.KeyRotated(user).IsZero() {
+		t.Error("old key is loaded after the grace period")
+	}
+	if err := db.RotateKey(user, pr.RenewPrivKey(oldpriv)); err != nil {
+		t.Errorf("key is not rotated after the grace period: %s", err.Error())
+	}
+}
+
+// Keys of the shared user are read while they are changed.
+func TestUserKeys(t *testing.T) {
+	db := newTestDB(t)
+	user := hestest.NewUser(t, db, "username", "password1", pr.NewPrivKey("x25519"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			for _, priv := range user.Keys() {
+				priv.PubKey()
+			}
+			user.Identities()
+		}
+	}()
+	identity := pr.NewPrivKey("x25519")
+	if err := db.SetIdentity(user, "identity", identity); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RotateKey(user, pr.RenewPrivKey(user.Priv())); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ChangePassword(user, "password2"); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if len(user.Keys()) != 3 || len(user.Identities()) != 1 {
+		t.Fatalf("%d keys, %d identities", len(user.Keys()), len(user.Identities()))
+	}
+	if err := db.DelIdentity(user, identity.PubKey()); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Identities()) != 0 {
+		t.Error("identity is not deleted from the user")
+	}
+	if err := db.SetContact(user, "friend", identity.PubKey()); err != nil {
+		t.Fatal(err)
+	}
+	loaded := db.GetUser("username", "password2")
+	if db.GetContactName(loaded, identity.PubKey()) != "friend" {
+		t.Error("key of the new password is not used by the user")
+	}
+}
+
+func TestRestoreEmail(t *testing.T) {
+	db := newTestDB(t)
+	user := hestest.NewUser(t, db, "username", "password1", pr.NewPrivKey("x25519"))
+	kept := hestest.NewEmail(user.Priv(), user.Priv(), "head", "body")
+	deleted := hestest.NewEmail(user.Priv(), user.Priv(), "head", "body")
+	for _, pack := range []lc.Message{kept, deleted} {
+		if err := db.SetEmail(user, user.Priv().PubKey(), pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DelEmail(user, db.GetEmailByPack(user, deleted).Hash); err != nil {
+		t.Fatal(err)
+	}
+	mailbox := db.GetMailbox(user)
+	if len(mailbox) != 1 || mailbox[0].Pack == "" {
+		t.Fatal("package hash is not in the mailbox")
+	}
+	hashes := db.GetDeleted(user)
+	if len(hashes) != 1 {
+		t.Fatalf("%d package hashes of deleted emails", len(hashes))
+	}
+
+	restored := hestest.NewUser(t, db, "username2", "password2", user.Priv())
+	if err := db.RestoreEmail(restored, &mailbox[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RestoreDeleted(restored, hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if db.GetEmailByPack(restored, kept) == nil {
+		t.Fatal("restored email is not found by the package")
+	}
+	if len(db.GetMailbox(restored)) != 1 {
+		t.Error("deleted email is in the mailbox")
+	}
+	if db.SetEmail(restored, user.Priv().PubKey(), kept) == nil {
+		t.Error("restored email is saved again")
+	}
+	if db.SetEmail(restored, user.Priv().PubKey(), deleted) == nil {
+		t.Error("deleted email is saved again")
+	}
+	if db.RestoreDeleted(restored, "not base64!") == nil {
+		t.Error("deleted email is restored by invalid hash")
+	}
+}
+
+func TestImportContact(t *testing.T) {
+	var (
+		key1 = pr.NewPrivKey("x25519").PubKey().String()
+		key2 = pr.NewPrivKey("x25519").PubKey().String()
+	)
+	tests := []struct {
+		name     string
+		contact  sr.Contact
+		replace  bool
+		ok       bool
+		names    map[string]string
+		verified bool
+	}{
+		{"same", sr.Contact{Name: "friend", Publ: key1}, false, false, map[string]string{key1: "friend"}, false},
+		{"verify same", sr.Contact{Name: "friend", Publ: key1, Verified: true}, true, true, map[string]string{key1: "friend"}, true},
+		{"same key", sr.Contact{Name: "other", Publ: key1}, false, false, map[string]string{key1: "friend"}, false},
+		{"same name", sr.Contact{Name: "friend", Publ: key2}, false, false, map[string]string{key1: "friend", key2: ""}, false},
+		{"replace key", sr.Contact{Name: "other", Publ: key1, Verified: true}, true, true, map[string]string{key1: "other"}, true},
+		{"replace name", sr.Contact{Name: "friend", Publ: key2}, true, true, map[string]string{key1: "", key2: "friend"}, false},
+		{"new", sr.Contact{Name: "other", Publ: key2}, false, true, map[string]string{key1: "friend", key2: "other"}, false},
+		{"null key", sr.Contact{Name: "other", Publ: "key"}, true, false, map[string]string{key1: "friend"}, false},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		user := hestest.NewUser(t, db, "username", "password1", pr.NewPrivKey("x25519"))
+		if err := db.SetContact(user, "friend", pr.LoadPubKeyByString(key1)); err != nil {
+			t.Fatal(err)
+		}
+		err := db.ImportContact(user, tt.contact, tt.replace)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+		for key, name := range tt.names {
+			if got := db.GetContactName(user, pr.LoadPubKeyByString(key)); got != name {
+				t.Errorf("%s: name '%s' != '%s'", tt.name, got, name)
+			}
+		}
+		if db.IsVerified(user, pr.LoadPubKeyByString(tt.contact.Publ)) != tt.verified {
+			t.Errorf("%s: verified != %v", tt.name, tt.verified)
+		}
+	}
+}
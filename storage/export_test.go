@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"encoding/base32"
+	"time"
+)
+
+// Rotation is moved to the past to end the grace period.
+func (db *DB) SetRotated(user *User, rotated time.Time) {
+	db.ptr.Exec("UPDATE users SET rotated=$1 WHERE id=$2", rotated.Unix(), user.Id)
+}
+
+func (db *DB) OldKeyStored(user *User) bool {
+	var stored bool
+	db.ptr.QueryRow("SELECT oldpriv IS NOT NULL FROM users WHERE id=$1", user.Id).Scan(&stored)
+	return stored
+}
+
+// Code of the current time step for the external tests.
+func GetTOTP(secret string) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	return getTOTP(key, uint64(time.Now().Unix())/TOTPPERIOD)
+}
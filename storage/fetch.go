@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+
+	cr "github.com/number571/go-peer/crypto"
+	lc "github.com/number571/go-peer/local"
+
+	pr "github.com/number571/hes/protocol"
+)
+
+// Emails are loaded for all keys of the user: main,
+// old during the grace period and identities.
+// The handler gets every new saved email.
+// The first error of loading is returned,
+// emails are loaded for the other keys anyway.
+func (db *DB) LoadEmails(ctx context.Context, hc *http.Client, user *User, addr string, max int, handle func(*Email)) (int, error) {
+	var (
+		count int
+		fail  error
+	)
+	for _, priv := range user.Keys() {
+		n, err := db.loadEmailsByKey(ctx, hc, user, priv, addr, max, handle)
+		if err != nil && fail == nil {
+			fail = err
+		}
+		count += n
+	}
+	return count, fail
+}
+
+func (db *DB) loadEmailsByKey(ctx context.Context, hc *http.Client, user *User, priv cr.PrivKey, addr string, max int, handle func(*Email)) (int, error) {
+	count := 0
+	err := pr.Load(ctx, hc, addr, priv, max, func(pack lc.Message) error {
+		title, _ := pack.Export()
+		switch string(title) {
+		case pr.IS_ROTATE:
+			return db.SetRotation(user, pack)
+		default:
+			err := db.SetEmail(user, priv.PubKey(), pack)
+			if err != nil {
+				return err
+			}
+			if email := db.GetEmailByPack(user, pack); email != nil && handle != nil {
+				handle(email)
+			}
+			count++
+			return nil
+		}
+	})
+	return count, err
+}
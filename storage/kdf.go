@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	cr "github.com/number571/go-peer/crypto"
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters are stored in the users row and in archives:
+// raise:diff or argon2id:time:memory(KiB):threads
+// New accounts, changed passwords and archives use the
+// parameters of the database, KDFDEFAULT if they are not set.
+const (
+	KDFLEGACY  = "raise:25"
+	KDFDEFAULT = "argon2id:3:65536:4"
+	KDFKEYSIZE = 32 // bytes
+)
+
+// Parameters of archives are not trusted,
+// so the cost of the derivation is limited.
+const (
+	KDFMAXDIFF    = 32
+	KDFMAXTIME    = 16
+	KDFMAXMEMORY  = 1 << 20 // KiB
+	KDFMAXTHREADS = 64
+)
+
+func DeriveKey(kdf string, pasw, salt []byte) ([]byte, error) {
+	derive, err := newKDF(kdf)
+	if err != nil {
+		return nil, err
+	}
+	return derive(pasw, salt), nil
+}
+
+// Parameters are checked without the derivation.
+func CheckKDF(kdf string) error {
+	_, err := newKDF(kdf)
+	return err
+}
+
+func newKDF(kdf string) (func(pasw, salt []byte) []byte, error) {
+	params := strings.Split(kdf, ":")
+	switch {
+	case params[0] == "raise" && len(params) == 2:
+		diff, err := strconv.ParseUint(params[1], 10, 8)
+		if err != nil || diff > KDFMAXDIFF {
+			return nil, fmt.Errorf("kdf is not valid")
+		}
+		return func(pasw, salt []byte) []byte {
+			return cr.RaiseEntropy(pasw, salt, diff)
+		}, nil
+	case params[0] == "argon2id" && len(params) == 4:
+		time, err1 := strconv.ParseUint(params[1], 10, 32)
+		memory, err2 := strconv.ParseUint(params[2], 10, 32)
+		threads, err3 := strconv.ParseUint(params[3], 10, 8)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("kdf is not valid")
+		}
+		if time < 1 || time > KDFMAXTIME || threads < 1 || threads > KDFMAXTHREADS {
+			return nil, fmt.Errorf("kdf is not valid")
+		}
+		if memory < 8*threads || memory > KDFMAXMEMORY {
+			return nil, fmt.Errorf("kdf is not valid")
+		}
+		return func(pasw, salt []byte) []byte {
+			return argon2.IDKey(pasw, salt, uint32(time), uint32(memory), uint8(threads), KDFKEYSIZE)
+		}, nil
+	}
+	return nil, fmt.Errorf("kdf is not supported")
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	var (
+		pasw = []byte("password")
+		salt = []byte("salt of the user")
+	)
+	tests := []struct {
+		kdf  string
+		size int
+	}{
+		{"raise:10", 32},
+		{KDFDEFAULT, KDFKEYSIZE},
+		{"argon2id:1:1024:1", KDFKEYSIZE},
+		{"raise", 0},
+		{"raise:x", 0},
+		{"argon2id:1:1024", 0},
+		{"argon2id:1:x:1", 0},
+		{"argon2id:0:1024:1", 0},
+		{"argon2id:1:1024:0", 0},
+		{"argon2id:1:4:1", 0},
+		{"argon2id:1:4294967295:1", 0},
+		{"argon2id:100:1024:1", 0},
+		{"raise:40", 0},
+		{"scrypt:1", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if (CheckKDF(tt.kdf) == nil) != (tt.size != 0) {
+			t.Errorf("%s: check is not valid", tt.kdf)
+		}
+		key, err := DeriveKey(tt.kdf, pasw, salt)
+		if tt.size == 0 {
+			if err == nil {
+				t.Errorf("%s: key is derived", tt.kdf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.kdf, err.Error())
+		}
+		if len(key) != tt.size {
+			t.Errorf("%s: len key %d != %d", tt.kdf, len(key), tt.size)
+		}
+		again, _ := DeriveKey(tt.kdf, pasw, salt)
+		if !bytes.Equal(key, again) {
+			t.Errorf("%s: key is not deterministic", tt.kdf)
+		}
+		other, _ := DeriveKey(tt.kdf, pasw, []byte("other salt"))
+		if bytes.Equal(key, other) {
+			t.Errorf("%s: key does not depend on salt", tt.kdf)
+		}
+		other, _ = DeriveKey(tt.kdf, []byte("other password"), salt)
+		if bytes.Equal(key, other) {
+			t.Errorf("%s: key does not depend on password", tt.kdf)
+		}
+	}
+}
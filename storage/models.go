@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"database/sql"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+	cr "github.com/number571/go-peer/crypto"
+)
+
+type DB struct {
+	ptr *sql.DB
+	kdf string
+	mtx sync.Mutex
+}
+
+// Keys are changed by the database while the user is shared
+// by sessions and tasks, so they are read by the methods.
+// The key of the password is used only by the database.
+type User struct {
+	Id         int
+	Name       string
+	pasw       []byte
+	priv       cr.PrivKey
+	oldpriv    cr.PrivKey
+	identities []Identity
+	mtx        sync.RWMutex
+}
+
+func (user *User) Priv() cr.PrivKey {
+	user.mtx.RLock()
+	defer user.mtx.RUnlock()
+	return user.priv
+}
+
+// Key before the rotation during the grace period.
+func (user *User) OldPriv() cr.PrivKey {
+	user.mtx.RLock()
+	defer user.mtx.RUnlock()
+	return user.oldpriv
+}
+
+// Identities besides the main key pair,
+// the slice is replaced and not changed.
+func (user *User) Identities() []Identity {
+	user.mtx.RLock()
+	defer user.mtx.RUnlock()
+	return user.identities
+}
+
+// Keys of the main pair, of the old pair and of identities
+// are read at once to load emails of all addresses.
+func (user *User) Keys() []cr.PrivKey {
+	user.mtx.RLock()
+	defer user.mtx.RUnlock()
+	keys := []cr.PrivKey{user.priv}
+	if user.oldpriv != nil {
+		keys = append(keys, user.oldpriv)
+	}
+	for _, identity := range user.identities {
+		keys = append(keys, identity.Priv)
+	}
+	return keys
+}
+
+func (user *User) setIdentities(identities []Identity) {
+	user.mtx.Lock()
+	defer user.mtx.Unlock()
+	user.identities = identities
+}
+
+type Identity struct {
+	Name string
+	Priv cr.PrivKey
+}
+
+type Contact struct {
+	Name     string `json:"name"`
+	Publ     string `json:"publ"`
+	Verified bool   `json:"verified"`
+}
+
+type Rotation struct {
+	Name    string
+	OldPubl string
+	NewPubl string
+	Sign    string
+}
+
+type Email struct {
+	Id         int
+	SenderName string
+	SenderPubl string
+	Head       string
+	Body       string
+	Hash       string
+	Pack       string
+	Time       string
+	Files      [][2]string
+	Contact    string
+	RecvPubl   string
+	Identity   string
+}
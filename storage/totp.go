@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	cr "github.com/number571/go-peer/crypto"
+	en "github.com/number571/go-peer/encoding"
+)
+
+// RFC 6238 with the parameters of common authenticator apps.
+const (
+	TOTPPERIOD = 30 // seconds
+	TOTPDIGITS = 6
+	TOTPWINDOW = 1 // periods before and after
+	TOTPCODES  = 8 // recovery codes
+)
+
+func NewTOTPSecret() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(cr.RandBytes(20))
+}
+
+func NewRecoveryCodes() []string {
+	codes := make([]string, TOTPCODES)
+	for i := range codes {
+		codes[i] = fmt.Sprintf("%X", cr.RandBytes(5))
+	}
+	return codes
+}
+
+// Returns the time step of the accepted code or zero.
+func CheckTOTP(secret, code string, last uint64) uint64 {
+	return checkTOTP(secret, code, last, time.Now())
+}
+
+func checkTOTP(secret, code string, last uint64, now time.Time) uint64 {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return 0
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	step := uint64(now.Unix()) / TOTPPERIOD
+	for i := step - TOTPWINDOW; i <= step+TOTPWINDOW; i++ {
+		// a code can not be used twice
+		if i <= last {
+			continue
+		}
+		if hmac.Equal([]byte(getTOTP(key, i)), []byte(code)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// code = truncate(hmac_sha1[key](step)) mod 10^digits
+func getTOTP(key []byte, step uint64) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(en.Uint64ToBytes(step))
+	hash := mac.Sum(nil)
+	offset := hash[len(hash)-1] & 0x0F
+	value := (uint32(hash[offset])&0x7F)<<24 |
+		uint32(hash[offset+1])<<16 |
+		uint32(hash[offset+2])<<8 |
+		uint32(hash[offset+3])
+	mod := uint32(1)
+	for i := 0; i < TOTPDIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDIGITS, value%mod)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// Test vectors of RFC 6238 for SHA1, the last six digits.
+func TestCheckTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.time, 0)
+		step := uint64(tt.time) / TOTPPERIOD
+		if got := checkTOTP(secret, tt.code, 0, now); got != step {
+			t.Errorf("%d: step %d != %d", tt.time, got, step)
+		}
+		if checkTOTP(secret, tt.code[:3]+" "+tt.code[3:], 0, now) != step {
+			t.Errorf("%d: code with space is not accepted", tt.time)
+		}
+		if checkTOTP(secret, tt.code, step, now) != 0 {
+			t.Errorf("%d: code is used twice", tt.time)
+		}
+		if checkTOTP(secret, tt.code, 0, now.Add(3*TOTPPERIOD*time.Second)) != 0 {
+			t.Errorf("%d: code is accepted out of window", tt.time)
+		}
+	}
+	if checkTOTP("not base32!", "287082", 0, time.Unix(59, 0)) != 0 {
+		t.Errorf("code is accepted with invalid secret")
+	}
+}
+
+func TestCheckTOTPWindow(t *testing.T) {
+	secret := NewTOTPSecret()
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	now := time.Unix(1111111111, 0)
+	step := uint64(now.Unix()) / TOTPPERIOD
+	for i := step - TOTPWINDOW; i <= step+TOTPWINDOW; i++ {
+		if checkTOTP(secret, getTOTP(key, i), 0, now) != i {
+			t.Errorf("code of step %d is not accepted", i)
+		}
+	}
+}